@@ -3,6 +3,7 @@ package cache
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -53,6 +54,22 @@ func (c *cache) get(k string) (interface{}, bool) {
 	return item.Value, true
 }
 
+func (c *cache) delete(k string) {
+	c.mtx.Lock()
+	delete(c.items, k)
+	c.mtx.Unlock()
+}
+
+func (c *cache) deletePrefix(prefix string) {
+	c.mtx.Lock()
+	for k := range c.items {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.items, k)
+		}
+	}
+	c.mtx.Unlock()
+}
+
 func (c *cache) run(d time.Duration) {
 	for range time.Tick(d) {
 		c.deleteExpired()
@@ -3,6 +3,7 @@ package cache
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"gitlab.com/noamdb/modernboard/repository"
@@ -55,6 +56,11 @@ func (c *ThreadsPageCache) GetPage(URI string, page int) ([]byte, bool) {
 	return nil, false
 }
 
+// DeleteBoard removes all the cached pages of the board
+func (c *ThreadsPageCache) DeleteBoard(URI string) {
+	c.deletePrefix(URI + "_")
+}
+
 type ThreadCache struct {
 	cache
 }
@@ -65,14 +71,18 @@ func (c *ThreadCache) InsertThread(threadID int, thread repository.ThreadWithPos
 		fmt.Println("error while inserting thread", err)
 		return []byte{}
 	}
-	c.set(string(threadID), j, time.Second*7)
+	c.set(strconv.Itoa(threadID), j, time.Second*7)
 	return j
 }
 
 func (c *ThreadCache) GetThread(threadID int) ([]byte, bool) {
-	threads, exists := c.get(string(threadID))
+	threads, exists := c.get(strconv.Itoa(threadID))
 	if exists {
 		return threads.([]byte), exists
 	}
 	return nil, false
 }
+
+func (c *ThreadCache) DeleteThread(threadID int) {
+	c.delete(strconv.Itoa(threadID))
+}
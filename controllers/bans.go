@@ -13,16 +13,24 @@ import (
 )
 
 type BansResource struct {
-	Repo *repository.Repository
-	Bc   *cache.BanCache
+	Repo         *repository.Repository
+	Bc           *cache.BanCache
+	ThreadsPageC *cache.ThreadsPageCache
+	ThreadCacheC *cache.ThreadCache
 }
 
 func (rs BansResource) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Use(Authorize(rs.Repo, utils.MOD))
-	r.Post(`/posts/{postID:[0-9]{1,20}}`, rs.BanPoster)
-	r.Post(`/ip`, rs.BanIP)
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.Ban))
+		r.Post(`/posts/{postID:[0-9]{1,20}}`, rs.BanPoster)
+		r.Post(`/posts/{postID:[0-9]{1,20}}/delete`, rs.BanAndDelete)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.BanRange))
+		r.Post(`/ip`, rs.BanIP)
+	})
 
 	return r
 }
@@ -44,6 +52,10 @@ func (rs BansResource) BanPoster(w http.ResponseWriter, r *http.Request) {
 		CreatorID: r.Context().Value("user").(repository.User).ID,
 		Reason:    b.Reason}
 	IP, err := rs.Repo.BanPoster(bpi)
+	if err == repository.ErrIPExpired {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "ban poster",
@@ -55,6 +67,42 @@ func (rs BansResource) BanPoster(w http.ResponseWriter, r *http.Request) {
 	go rs.Bc.InsertBan(IP, bpi.Reason)
 }
 
+// BanAndDelete bans the poster and deletes its posts in the thread or board of the post
+func (rs BansResource) BanAndDelete(w http.ResponseWriter, r *http.Request) {
+	b := &BanDeleteCreate{}
+	err := json.NewDecoder(r.Body).Decode(b)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !b.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+	user := r.Context().Value("user").(repository.User)
+
+	bpi := repository.BanPosterInsert{PostID: postID,
+		CreatorID: user.ID,
+		Reason:    b.Reason}
+	IP, posts, err := rs.Repo.BanAndDeletePoster(bpi, b.Scope, user.Boards)
+	if err == repository.ErrIPExpired {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "ban and delete",
+			"error": err,
+		}).Error("could not ban and delete poster", postID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	go rs.Bc.InsertBan(IP, bpi.Reason)
+	invalidatePosts(posts, rs.ThreadsPageC, rs.ThreadCacheC)
+	json.NewEncoder(w).Encode(posts)
+}
+
 func (rs BansResource) BanIP(w http.ResponseWriter, r *http.Request) {
 	b := &BanIPCreate{}
 	err := json.NewDecoder(r.Body).Decode(b)
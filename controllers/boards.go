@@ -5,8 +5,10 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/noamdb/modernboard/cache"
+	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/utils"
 )
@@ -22,7 +24,7 @@ func (rs BoardsResource) Routes() chi.Router {
 	r.Route(`/`, func(r chi.Router) {
 		r.Get(`/`, rs.List)
 		r.Group(func(r chi.Router) {
-			r.Use(Authorize(rs.Repo, utils.ADMIN))
+			r.Use(Require(rs.Repo, utils.ManageBoards))
 			r.Post(`/`, rs.Create)
 		})
 	})
@@ -32,11 +34,19 @@ func (rs BoardsResource) Routes() chi.Router {
 func (rs BoardsResource) ManageRoutes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Use(Authorize(rs.Repo, utils.JANITOR))
+	r.Use(Require(rs.Repo, utils.Moderate))
 	r.Get(`/`, rs.ListManage)
 	return r
 
 }
+func (rs BoardsResource) SettingsRoutes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Use(Require(rs.Repo, utils.ManageBoards))
+	r.Put(`/`, rs.UpdateSettings)
+	return r
+}
+
 func (rs BoardsResource) List(w http.ResponseWriter, r *http.Request) {
 	b, exists := rs.BoardsC.GetBoards()
 	if exists {
@@ -58,13 +68,15 @@ func (rs BoardsResource) List(w http.ResponseWriter, r *http.Request) {
 }
 
 func (rs BoardsResource) Create(w http.ResponseWriter, r *http.Request) {
-	board := &repository.BoardCreate{}
+	board := &repository.BoardCreate{BoardSettings: repository.BoardSettings{
+		BumpLimit: repository.DefaultBumpLimit, Markup: utils.DefaultMarkup,
+		AllowedTypes: pq.StringArray(media.DefaultExtensions)}}
 	err := json.NewDecoder(r.Body).Decode(board)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !board.Valid() {
+	if !board.Valid() || !media.ValidExtensions(board.AllowedTypes) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -96,3 +108,31 @@ func (rs BoardsResource) ListManage(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(boards)
 }
+
+func (rs BoardsResource) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	boardURI := chi.URLParam(r, "boardURI")
+	settings := &repository.BoardSettings{}
+	err := json.NewDecoder(r.Body).Decode(settings)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// without allowed_types the board keeps its file types
+	if !settings.Valid() || (settings.AllowedTypes != nil && !media.ValidExtensions(settings.AllowedTypes)) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rs.Repo.UpdateBoardSettings(boardURI, *settings,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "update board settings",
+			"error":     err,
+			"board_uri": boardURI,
+		}).Error("could not update board settings")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.BoardsC.Flush()
+}
@@ -1,41 +1,137 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-chi/chi"
-	"github.com/spf13/viper"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/media"
+	"gitlab.com/noamdb/modernboard/repository"
 )
 
 type FilesResource struct {
+	Repo    *repository.Repository
+	Storage media.Storage
 }
 
-var fs http.Handler
-
 func (rs FilesResource) Routes() chi.Router {
 	r := chi.NewRouter()
-	r.Route("/*", func(r chi.Router) {
-		r.Get("/*", rs.Get)
-	})
+	r.Get("/files/{file}", rs.GetFile)
+	r.Get("/download/{file}", rs.Download)
+	r.Get("/thumbnails/{file}", rs.GetThumbnail)
+	return r
+}
 
-	fs = http.StripPrefix("/static/", http.FileServer(http.Dir(viper.GetString("static_path"))))
+// GetFile serves the uploaded file by its random name, it is cached for long so it never
+// carries the original name that the board may hide later, the name is sent by Download
+func (rs FilesResource) GetFile(w http.ResponseWriter, r *http.Request) {
+	file := chi.URLParam(r, "file")
+	if !media.ValidFileName(file) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rs.serve(w, r, "files/"+file, true)
+}
 
-	return r
+// Download serves the uploaded file as an attachment with its original name, the file
+// is always proxied because a redirect loses the name. the name may be hidden later
+// by the board so it isn't cached for long
+func (rs FilesResource) Download(w http.ResponseWriter, r *http.Request) {
+	file := chi.URLParam(r, "file")
+	if !media.ValidFileName(file) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", rs.downloadName(file)))
+	rs.proxy(w, r, "files/"+file, false)
 }
 
-// TODO: images not showing when opening in new tab
-func (rs FilesResource) Get(w http.ResponseWriter, r *http.Request) {
-	file := strings.Split(r.URL.Path, "/")
+// downloadName is the original name of the file, or the name of the file if the board hides it
+func (rs FilesResource) downloadName(file string) string {
+	name, err := rs.Repo.GetFileOriginalName(file)
+	if err != nil || name == "" {
+		return file
+	}
+	// transcoded files keep the original name with the new extension
+	return strings.TrimSuffix(name, filepath.Ext(name)) + filepath.Ext(file)
+}
 
-	// default FileServer behavior is to list the files in the directory.
-	// we dont want this so we make sure the path is not a folder
-	// folder names are short but file names are long strings
-	if len(file[len(file)-1]) < 15 {
+// GetThumbnail serves the thumbnails, the spoiler and the processing thumbnails
+// may be replaced so they aren't cached for long
+func (rs FilesResource) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	file := chi.URLParam(r, "file")
+	switch {
+	case file == repository.SpoilerThumbnail || file == repository.ProcessingThumbnail:
+		rs.serve(w, r, "thumbnails/"+file, false)
+	case media.ValidFileName(file) && filepath.Ext(file) == ".webp":
+		rs.serve(w, r, "thumbnails/"+file, true)
+	default:
 		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serve redirects to the file when the storage has a public URL, otherwise the file is proxied
+func (rs FilesResource) serve(w http.ResponseWriter, r *http.Request, key string, immutable bool) {
+	if u := rs.Storage.URL(key); u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
 		return
 	}
-	// time.Sleep(2 * time.Second)
+	rs.proxy(w, r, key, immutable)
+}
 
-	fs.ServeHTTP(w, r)
+// proxy serves the file from the storage with range requests, so videos can be seeked
+func (rs FilesResource) proxy(w http.ResponseWriter, r *http.Request, key string, immutable bool) {
+	f, err := rs.Storage.Get(key)
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "get file",
+			"error": err,
+			"key":   key,
+		}).Error("could not get file from storage")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer f.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", media.ContentType(key))
+	h.Set("X-Content-Type-Options", "nosniff")
+	// the names of uploaded files are never reused so their content never changes
+	if immutable {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "public, max-age=3600")
+	}
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, f.ModTime().UnixNano(), f.Size()))
+	http.ServeContent(w, r, "", f.ModTime(), f)
+}
+
+// contentDisposition has an ASCII fallback of the name for old clients and
+// the UTF-8 name encoded by RFC 5987
+func contentDisposition(disposition string, name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, encoded.String())
 }
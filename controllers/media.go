@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/cache"
+	"gitlab.com/noamdb/modernboard/media"
+	"gitlab.com/noamdb/modernboard/repository"
+)
+
+type MediaResource struct {
+	Repo *repository.Repository
+}
+
+func (rs MediaResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get(`/jobs/{jobID:[0-9]+}`, rs.GetJob)
+	return r
+}
+
+func (rs MediaResource) GetJob(w http.ResponseWriter, r *http.Request) {
+	jobID, _ := strconv.Atoi(chi.URLParam(r, "jobID"))
+	job, err := rs.Repo.GetMediaJob(jobID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":  "get media job",
+			"error":  err,
+			"job_id": jobID,
+		}).Error("could not get media job")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// NewMediaQueue creates the queue that processes the uploaded files,
+// the cached pages of a post are removed when its file is processed
+func NewMediaQueue(repo *repository.Repository, tpc *cache.ThreadsPageCache, tc *cache.ThreadCache) *media.Queue {
+	return media.NewQueue(repo, func(postID int) {
+		location, err := repo.GetPostLocation(postID)
+		if err != nil {
+			// the post was deleted
+			return
+		}
+		invalidatePosts([]repository.PostLocation{location}, tpc, tc)
+	})
+}
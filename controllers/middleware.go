@@ -7,28 +7,49 @@ import (
 	"strconv"
 	"strings"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"gitlab.com/noamdb/modernboard/cache"
 	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/utils"
 )
 
-// Authorize - Authenticate user from cookie then Authorize
-func Authorize(repo *repository.Repository, minAllowed string) func(next http.Handler) http.Handler {
+// Authenticate - Authenticate user from cookie, API tokens can't manage the account of the user
+func Authenticate(repo *repository.Repository) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			cookie, err := r.Cookie("session")
-			if err != nil {
+			p, ok := currentUser(repo, r)
+			if !ok {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			ctx := context.WithValue(r.Context(), "user", p)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
 
-			p, err := repo.GetUserDetails(cookie.Value)
-			if err != nil {
+// Require - Authenticate user from API token or cookie then authorize the capability.
+// users that must enable 2FA and didn't are forbidden.
+// the boards of the user in the context are only the boards where the user has the capability,
+// so the board checks of the repository are checks of the capability.
+// global capabilities are checked only against the role of the user
+func Require(repo *repository.Repository, capability string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := requestUser(repo, r)
+			if !ok {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			if !utils.CheckPermission(minAllowed, p.Role) {
+			if p.NeedsTwoFactor() {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			p.Boards = p.BoardsWith(capability)
+			if !utils.HasCapability(p.Capabilities, capability) &&
+				(utils.IsGlobalCapability(capability) || len(p.Boards) == 0) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
@@ -38,6 +59,66 @@ func Authorize(repo *repository.Repository, minAllowed string) func(next http.Ha
 	}
 }
 
+// currentUser returns the user of the session cookie if the request has one
+func currentUser(repo *repository.Repository, r *http.Request) (repository.User, bool) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return repository.User{}, false
+	}
+	p, err := repo.GetUserDetails(cookie.Value, viper.GetInt("session_idle_hours"))
+	if err != nil {
+		return repository.User{}, false
+	}
+	if err = repo.TouchSession(p.SessionID); err != nil {
+		log.WithFields(log.Fields{
+			"event": "touch session",
+			"error": err,
+		}).Error("could not update session last seen")
+	}
+	return p, true
+}
+
+// requestUser returns the user of the API token of the Authorization header,
+// or of the session cookie if the request has no token. token use is recorded in the audit log
+func requestUser(repo *repository.Repository, r *http.Request) (repository.User, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return currentUser(repo, r)
+	}
+	p, err := repo.GetTokenUser(utils.HashAPIToken(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return repository.User{}, false
+	}
+	IP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if err = repo.UseAPIToken(p.ID, p.TokenID, IP); err != nil {
+		log.WithFields(log.Fields{
+			"event":    "use api token",
+			"error":    err,
+			"token_id": p.TokenID,
+		}).Error("could not record api token use")
+	}
+	return p, true
+}
+
+// verifiedCapcode returns the requested capcode and true if the poster is logged in with the role
+// of the capcode and is allowed to use it on the board, it is false if a capcode was requested
+// but isn't allowed
+func verifiedCapcode(repo *repository.Repository, r *http.Request, capcode string, boardID int) (string, bool) {
+	if capcode == "" {
+		return "", true
+	}
+	user, ok := requestUser(repo, r)
+	if !ok || capcode != user.Role || user.NeedsTwoFactor() {
+		return "", false
+	}
+	for _, b := range user.BoardsWith(utils.Capcode) {
+		if b == int64(boardID) {
+			return capcode, true
+		}
+	}
+	return "", false
+}
+
 func paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		page, err := strconv.Atoi(r.URL.Query().Get("page"))
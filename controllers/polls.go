@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/cache"
+	"gitlab.com/noamdb/modernboard/repository"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+type PollsResource struct {
+	Repo         *repository.Repository
+	ThreadCacheC *cache.ThreadCache
+}
+
+func (rs PollsResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Post(`/votes`, rs.Vote)
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.ManageThreads))
+		r.Post(`/close`, rs.Close)
+		r.Delete(`/votes`, rs.Reset)
+	})
+	return r
+}
+
+func (rs PollsResource) Vote(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+	v := &Vote{}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !v.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	IP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	err = rs.Repo.Vote(threadID, utils.EncryptString(IP), pq.Int64Array(v.Options))
+	if err == repository.ErrAlreadyVoted || err == repository.ErrPollClosed {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "vote",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not vote")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+}
+
+func (rs PollsResource) Close(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+
+	err := rs.Repo.ClosePoll(threadID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "close poll",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not close poll")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+}
+
+// Reset removes all the votes of the poll
+func (rs PollsResource) Reset(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+
+	err := rs.Repo.ResetPoll(threadID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "reset poll",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not reset poll")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+}
@@ -5,17 +5,23 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gitlab.com/noamdb/modernboard/cache"
 	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/utils"
 )
 
 type PostsResource struct {
-	Repo *repository.Repository
+	Repo         *repository.Repository
+	ThreadsPageC *cache.ThreadsPageCache
+	ThreadCacheC *cache.ThreadCache
+	MediaQ       *media.Queue
 }
 
 func (rs PostsResource) PostsRoutes() chi.Router {
@@ -25,13 +31,31 @@ func (rs PostsResource) PostsRoutes() chi.Router {
 		r.Get(`/after`, rs.ListAfter)
 		r.Post(`/reports`, rs.Report)
 		r.Group(func(r chi.Router) {
-			r.Use(Authorize(rs.Repo, utils.JANITOR))
+			r.Use(Require(rs.Repo, utils.DeletePost))
 			r.Delete(`/`, rs.Delete)
+			r.Delete(`/file`, rs.DeleteFile)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(Require(rs.Repo, utils.EditPost))
+			r.Put(`/`, rs.Edit)
+			r.Get(`/revisions`, rs.Revisions)
+			r.Post(`/spoiler`, rs.ToggleSpoiler)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(Require(rs.Repo, utils.PosterHistory))
+			r.Use(paginate)
+			r.Get(`/history`, rs.PosterHistory)
 		})
 	})
 
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.DeletePost))
+		r.Post(`/delete`, rs.DeleteMany)
+		r.Post(`/deleteAuthor`, rs.DeleteAuthor)
+	})
+
 	r.Route("/reports", func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.JANITOR))
+		r.Use(Require(rs.Repo, utils.Moderate))
 		r.Route("/", func(r chi.Router) {
 			r.Use(paginate)
 			r.Get("/", rs.ReportedPosts)
@@ -51,9 +75,9 @@ func (rs PostsResource) Create(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(10 << 20)
 	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
 	pc := PostCreate{threadID: threadID,
-		author:   r.PostFormValue("author"),
-		tripcode: r.PostFormValue("tripcode"),
-		body:     r.PostFormValue("body")}
+		author: utils.ParseAuthor(r.PostFormValue("author"), r.PostFormValue("tripcode")),
+		body:   r.PostFormValue("body"),
+		Bump:   !isSage(r)}
 	if !pc.valid() {
 		log.WithFields(log.Fields{
 			"event": "create post",
@@ -61,32 +85,48 @@ func (rs PostsResource) Create(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	board, err := rs.Repo.GetThreadBoard(pc.threadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	capcode, ok := verifiedCapcode(rs.Repo, r, pc.author.Capcode, board.ID)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	var fileName, thumbnailName, fileOriginalName string
+	var fi media.FileInfo
 	file, handler, err := r.FormFile("file")
 	if err == nil {
 		defer file.Close()
 
-		fileName, thumbnailName, err = media.HandleFile(file, 250)
+		fi, err = media.HandleFile(file, board.AllowedTypes)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		fileName, thumbnailName = fi.Name, fi.ThumbnailName
 		if len(handler.Filename) > 50 {
 			handler.Filename = handler.Filename[:50]
 		}
 		fileOriginalName = handler.Filename
 	}
-	html, replies := utils.HTMLAndReplies(pc.body)
-	pi := repository.PostInsert{ThreadID: pc.threadID, Author: pc.author,
-		Tripcode: utils.EncryptString(pc.tripcode),
+	html, replies := renderBody(rs.Repo, board.Board, pc.body)
+	pi := repository.PostInsert{ThreadID: pc.threadID, Author: pc.author.Name,
+		Tripcode: pc.author.Tripcode,
+		Capcode:  capcode,
 		Body:     pc.body, BodyHTML: html,
 		FileName: fileName, FileOriginalName: fileOriginalName,
-		ThumbnailName: thumbnailName, Bump: true,
-		Replies: pq.Int64Array(replies),
+		ThumbnailName: thumbnailName, Bump: pc.Bump,
+		FileSpoiler:     fileName != "" && r.PostFormValue("spoiler") == "true",
+		FileContentType: fi.ContentType,
+		FileMetadata:    fileMetadata(fi),
+		Replies:         pq.Int64Array(replies),
 	}
 	pi.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
 
-	err = rs.Repo.CreatePost(pi)
+	postID, jobID, err := rs.Repo.CreatePost(pi)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "create post",
@@ -94,8 +134,43 @@ func (rs PostsResource) Create(w http.ResponseWriter, r *http.Request) {
 		}).Error("could not create post in db")
 		media.DeleteFileAndThumbnail(fileName, thumbnailName)
 		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if board.IsCyclical {
+		rs.pruneCyclical(pc.threadID, board.Uri)
+	}
+	if jobID != 0 {
+		rs.MediaQ.Notify()
+	}
+	json.NewEncoder(w).Encode(struct {
+		repository.PostInsert
+		ID    int `json:"id"`
+		JobID int `json:"job_id,omitempty"`
+	}{pi, postID, jobID})
+}
+
+// pruneCyclical deletes the oldest replies of the cyclical thread
+func (rs PostsResource) pruneCyclical(threadID int, boardURI string) {
+	pruned, err := rs.Repo.PruneCyclicalThread(threadID, viper.GetInt("cyclical_posts_limit"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "prune cyclical thread",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not prune cyclical thread")
+		return
 	}
-	json.NewEncoder(w).Encode(pi)
+	if pruned == 0 {
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+	rs.ThreadsPageC.DeleteBoard(boardURI)
+}
+
+// isSage is true when the poster checked sage or wrote "sage" in the email field
+func isSage(r *http.Request) bool {
+	return r.PostFormValue("sage") == "true" ||
+		strings.EqualFold(strings.TrimSpace(r.PostFormValue("email")), "sage")
 }
 
 func (rs PostsResource) ListAfter(w http.ResponseWriter, r *http.Request) {
@@ -136,10 +211,15 @@ func (rs PostsResource) Report(w http.ResponseWriter, r *http.Request) {
 	}
 	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
 
-	rep := repository.ReportInsert{Reason: report.Reason, PostID: postID}
+	rep := repository.ReportInsert{Reason: report.Reason, PostID: postID,
+		CategoryID: report.CategoryID}
 	rep.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
 
-	err = rs.Repo.ReportPost(rep)
+	err = rs.Repo.ReportPost(rep, viper.GetInt("report_limit"), viper.GetInt("report_limit_minutes"))
+	if err == repository.ErrTooManyReports {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "report",
@@ -185,3 +265,203 @@ func (rs PostsResource) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (rs PostsResource) DeleteMany(w http.ResponseWriter, r *http.Request) {
+	pd := &PostsDelete{}
+	err := json.NewDecoder(r.Body).Decode(pd)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !pd.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	posts, err := rs.Repo.MarkPostsDeleted(pq.Int64Array(pd.IDs),
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "delete posts",
+			"error": err,
+		}).Error("could not delete posts", pd.IDs)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	invalidatePosts(posts, rs.ThreadsPageC, rs.ThreadCacheC)
+	json.NewEncoder(w).Encode(posts)
+}
+
+// DeleteAuthor deletes all the posts of the author in a thread or in a board
+func (rs PostsResource) DeleteAuthor(w http.ResponseWriter, r *http.Request) {
+	apd := &AuthorPostsDelete{}
+	err := json.NewDecoder(r.Body).Decode(apd)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !apd.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	boards := r.Context().Value("user").(repository.User).Boards
+
+	var posts []repository.PostLocation
+	if apd.ThreadID > 0 {
+		posts, err = rs.Repo.MarkAuthorThreadPostsDeleted(apd.AuthorID, apd.ThreadID, boards)
+	} else {
+		posts, err = rs.Repo.MarkAuthorBoardPostsDeleted(apd.AuthorID, apd.BoardURI, boards)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "delete author posts",
+			"error":     err,
+			"author_id": apd.AuthorID,
+		}).Error("could not delete author posts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	invalidatePosts(posts, rs.ThreadsPageC, rs.ThreadCacheC)
+	json.NewEncoder(w).Encode(posts)
+}
+
+// DeleteFile deletes the file of the post and keeps the text
+func (rs PostsResource) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+
+	f, post, err := rs.Repo.DeletePostFile(postID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "delete post file",
+			"error": err,
+		}).Error("could not delete post file", postID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	media.DeleteFileAndThumbnail(f.FileName, f.ThumbnailName)
+	invalidatePosts([]repository.PostLocation{post}, rs.ThreadsPageC, rs.ThreadCacheC)
+}
+
+// Edit replaces the body of the post, the previous body is kept as a revision
+func (rs PostsResource) Edit(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+	e := &PostEdit{}
+	err := json.NewDecoder(r.Body).Decode(e)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !e.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := r.Context().Value("user").(repository.User)
+
+	location, err := rs.Repo.GetPostLocation(postID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	board, err := rs.Repo.GetBoard(location.BoardURI)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	html, replies := renderBody(rs.Repo, board, e.Body)
+	post, err := rs.Repo.EditPost(repository.PostEdit{PostID: postID, EditorID: user.ID,
+		Body: e.Body, BodyHTML: html, Replies: pq.Int64Array(replies)}, user.Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "edit post",
+			"error":   err,
+			"post_id": postID,
+		}).Error("could not edit post")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	invalidatePosts([]repository.PostLocation{post}, rs.ThreadsPageC, rs.ThreadCacheC)
+}
+
+// PosterHistory lists the posts of the IP or author ID of the post in the boards of the user,
+// the IPs are shown only on the boards where the user can view IPs
+func (rs PostsResource) PosterHistory(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+	user := r.Context().Value("user").(repository.User)
+
+	posts, err := rs.Repo.GetPosterHistory(postID, user.Boards, user.BoardsWith(utils.ViewIP),
+		r.Context().Value("page").(int))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "poster history",
+			"error":   err,
+			"post_id": postID,
+		}).Error("could not get poster history")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(posts)
+}
+
+func (rs PostsResource) Revisions(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+
+	revisions, err := rs.Repo.GetPostRevisions(postID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "get post revisions",
+			"error":   err,
+			"post_id": postID,
+		}).Error("could not get post revisions")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// ToggleSpoiler adds or removes the spoiler of the file of the post
+func (rs PostsResource) ToggleSpoiler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(chi.URLParam(r, "postID"))
+
+	post, err := rs.Repo.ToggleFileSpoiler(postID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "toggle spoiler",
+			"error":   err,
+			"post_id": postID,
+		}).Error("could not toggle spoiler")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	invalidatePosts([]repository.PostLocation{post}, rs.ThreadsPageC, rs.ThreadCacheC)
+}
+
+// fileMetadata is the metadata of the uploaded file that is stored with the post,
+// the rest of the metadata is added by the media job of the file
+func fileMetadata(fi media.FileInfo) repository.FileMetadata {
+	return repository.FileMetadata{FileSize: fi.Size, FileProcessing: fi.Name != ""}
+}
+
+// renderBody renders the body with the markup of the board and the quotes resolved in the board,
+// quotes that can't be resolved are rendered as dead links
+func renderBody(repo *repository.Repository, board repository.Board, body string) (string, []int64) {
+	quotes, err := repo.ResolveQuotes(board.Uri, utils.ParseQuotes(body))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "resolve quotes",
+			"error":     err,
+			"board_uri": board.Uri,
+		}).Error("could not resolve quotes")
+	}
+	return utils.HTMLAndReplies(body, quotes, board.Markup)
+}
+
+// invalidatePosts removes the cached threads and board pages of the posts
+func invalidatePosts(posts []repository.PostLocation, tpc *cache.ThreadsPageCache, tc *cache.ThreadCache) {
+	for _, p := range posts {
+		tc.DeleteThread(p.ThreadID)
+		tpc.DeleteBoard(p.BoardURI)
+	}
+}
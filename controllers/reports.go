@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/repository"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+type ReportsResource struct {
+	Repo *repository.Repository
+}
+
+func (rs ReportsResource) BoardRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Get(`/categories`, rs.ListCategories)
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.ManageBoards))
+		r.Post(`/categories`, rs.CreateCategory)
+		r.Delete(`/categories/{categoryID:[0-9]+}`, rs.DeleteCategory)
+	})
+	return r
+}
+
+func (rs ReportsResource) ListCategories(w http.ResponseWriter, r *http.Request) {
+	boardURI := chi.URLParam(r, "boardURI")
+
+	categories, err := rs.Repo.GetReportCategories(boardURI)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "list report categories",
+			"error":     err,
+			"board_uri": boardURI,
+		}).Error("could not list report categories")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(categories)
+}
+
+func (rs ReportsResource) CreateCategory(w http.ResponseWriter, r *http.Request) {
+	category := &repository.ReportCategoryCreate{}
+	err := json.NewDecoder(r.Body).Decode(category)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !category.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	category.BoardURI = chi.URLParam(r, "boardURI")
+
+	err = rs.Repo.CreateReportCategory(*category,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "create report category",
+			"error":     err,
+			"board_uri": category.BoardURI,
+		}).Error("could not create report category")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (rs ReportsResource) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, _ := strconv.Atoi(chi.URLParam(r, "categoryID"))
+
+	err := rs.Repo.DeleteReportCategory(categoryID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":       "delete report category",
+			"error":       err,
+			"category_id": categoryID,
+		}).Error("could not delete report category")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/repository"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+type RolesResource struct {
+	Repo *repository.Repository
+}
+
+func (rs RolesResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Use(Require(rs.Repo, utils.ManageUsers))
+	r.Get(`/`, rs.List)
+	r.Put(`/{role}`, rs.Save)
+	r.Delete(`/{role}`, rs.Delete)
+	return r
+}
+
+func (rs RolesResource) List(w http.ResponseWriter, r *http.Request) {
+	roles, err := rs.Repo.GetRoles()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "list roles",
+			"error": err,
+		}).Error("could not list roles")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(roles)
+}
+
+// Save creates the role or changes its capabilities, only the 2FA requirement
+// of the admin role can be changed
+func (rs RolesResource) Save(w http.ResponseWriter, r *http.Request) {
+	role := &repository.Role{}
+	err := json.NewDecoder(r.Body).Decode(role)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	role.Name = chi.URLParam(r, "role")
+	if !role.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if role.Capabilities == nil {
+		role.Capabilities = pq.StringArray{}
+	}
+	err = rs.Repo.SaveRole(*role)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "save role",
+			"error": err,
+			"role":  role.Name,
+		}).Error("could not save role")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// Delete deletes the role if it has no users
+func (rs RolesResource) Delete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "role")
+	err := rs.Repo.DeleteRole(name)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "delete role",
+			"error": err,
+			"role":  name,
+		}).Error("could not delete role")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
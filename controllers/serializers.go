@@ -1,39 +1,101 @@
 package controllers
 
 import (
+	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/utils"
 )
 
 type threadCreate struct {
 	boardURI string
 	subject  string
-	author   string
-	tripcode string
+	author   utils.Author
 	body     string
 	fileName string
+	poll     *repository.PollInsert
 }
 
 func (tc threadCreate) valid() bool {
 	return utils.ValidLength(tc.subject, -1, 100) &&
-		utils.ValidLength(tc.author, 1, 20) &&
-		utils.ValidLength(tc.tripcode, -1, 30) &&
-		utils.ValidLength(tc.body, -1, 15000)
+		utils.ValidLength(tc.author.Name, 1, 20) &&
+		utils.ValidLength(tc.body, -1, 15000) &&
+		(tc.poll == nil || tc.poll.Valid())
+}
+
+type ThreadMove struct {
+	BoardURI string `json:"board_uri"`
+	Redirect bool   `json:"redirect"`
+}
+
+func (tm ThreadMove) valid() bool {
+	return utils.ValidLength(tm.BoardURI, 1, 10)
+}
+
+type ThreadMerge struct {
+	ThreadID int `json:"thread_id"`
+}
+
+func (tm ThreadMerge) valid() bool {
+	return tm.ThreadID > 0
+}
+
+type ThreadSplit struct {
+	PostID  int    `json:"post_id"`
+	Subject string `json:"subject"`
+}
+
+func (ts ThreadSplit) valid() bool {
+	return ts.PostID > 0 &&
+		utils.ValidLength(ts.Subject, -1, 100)
+}
+
+type Vote struct {
+	Options []int64 `json:"options"`
+}
+
+func (v Vote) valid() bool {
+	return len(v.Options) > 0 && len(v.Options) <= 10
 }
 
 type PostCreate struct {
 	threadID int
-	author   string
-	tripcode string
+	author   utils.Author
 	body     string
 	Bump     bool
 }
 
 func (pc PostCreate) valid() bool {
-	return utils.ValidLength(pc.author, 1, 20) &&
-		utils.ValidLength(pc.tripcode, 0, 30) &&
+	return utils.ValidLength(pc.author.Name, 1, 20) &&
 		utils.ValidLength(pc.body, 0, 15000)
 }
 
+type PostEdit struct {
+	Body string `json:"body"`
+}
+
+func (pe PostEdit) valid() bool {
+	return utils.ValidLength(pe.Body, 0, 15000)
+}
+
+type PostsDelete struct {
+	IDs []int64 `json:"ids"`
+}
+
+func (pd PostsDelete) valid() bool {
+	return len(pd.IDs) > 0 && len(pd.IDs) <= 100
+}
+
+// AuthorPostsDelete deletes the posts of the author in a thread or in a board
+type AuthorPostsDelete struct {
+	AuthorID string `json:"author_id"`
+	ThreadID int    `json:"thread_id"`
+	BoardURI string `json:"board_uri"`
+}
+
+func (apd AuthorPostsDelete) valid() bool {
+	return utils.ValidLength(apd.AuthorID, 1, 20) &&
+		(apd.ThreadID > 0) != utils.ValidLength(apd.BoardURI, 1, 10)
+}
+
 type UserLogin struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
@@ -45,16 +107,50 @@ func (ul UserLogin) Valid() bool {
 }
 
 type UserLoginResponse struct {
-	ID   int    `json:"id"`
-	Role string `json:"role"`
+	ID   int    `json:"id,omitempty"`
+	Role string `json:"role,omitempty"`
+	// TwoFactorPending is true when the login waits for the 2FA code
+	TwoFactorPending bool `json:"two_factor_pending,omitempty"`
+	// TwoFactorSetup is true when the role requires 2FA and the user should enable it
+	TwoFactorSetup bool `json:"two_factor_setup,omitempty"`
+}
+
+// TwoFactorCode is a TOTP code or a recovery code
+type TwoFactorCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (c TwoFactorCode) valid() bool {
+	return utils.ValidLength(c.Code, 6, 6) || utils.ValidLength(c.RecoveryCode, 1, 20)
+}
+
+type APITokenCreate struct {
+	Name         string   `json:"name"`
+	Capabilities []string `json:"capabilities"`
+	// Boards are the URIs of the boards of the token, all the boards of the user if it's empty
+	Boards []string `json:"boards"`
+	// ExpiresDays are the days until the token expires, it never expires if it's 0
+	ExpiresDays int `json:"expires_days"`
+}
+
+func (t APITokenCreate) valid() bool {
+	return utils.ValidLength(t.Name, 1, 50) && len(t.Capabilities) > 0 &&
+		utils.ValidCapabilities(t.Capabilities) && t.ExpiresDays >= 0 && t.ExpiresDays <= 3650
+}
+
+type TwoFactorDisable struct {
+	Password string `json:"password"`
 }
 
 type Report struct {
-	Reason string `json:"reason"`
+	Reason     string `json:"reason"`
+	CategoryID int    `json:"category_id"`
 }
 
 func (r Report) valid() bool {
-	return utils.ValidLength(r.Reason, 1, 100)
+	return r.CategoryID > 0 &&
+		utils.ValidLength(r.Reason, 0, 100)
 }
 
 type BanPosterCreate struct {
@@ -65,6 +161,16 @@ func (bpc BanPosterCreate) valid() bool {
 	return utils.ValidLength(bpc.Reason, 1, 100)
 }
 
+type BanDeleteCreate struct {
+	Reason string `json:"reason"`
+	Scope  string `json:"scope"`
+}
+
+func (bdc BanDeleteCreate) valid() bool {
+	return utils.ValidLength(bdc.Reason, 1, 100) &&
+		(bdc.Scope == "post" || bdc.Scope == "thread" || bdc.Scope == "board")
+}
+
 type BanIPCreate struct {
 	IP     string `json:"ip"`
 	Reason string `json:"reason"`
@@ -92,3 +198,15 @@ type BoardUserCreate struct {
 func (o BoardUserCreate) Valid() bool {
 	return utils.ValidLength(o.Name, 1, 20)
 }
+
+// UserPermissions are the effective permissions of the logged in user for the UI
+type UserPermissions struct {
+	ID           int                            `json:"id"`
+	Name         string                         `json:"name"`
+	Role         string                         `json:"role"`
+	Capabilities []string                       `json:"capabilities"`
+	Boards       []repository.BoardCapabilities `json:"boards"`
+	// TwoFactorSetup is true when the user must enable 2FA to use the capabilities
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	TwoFactorSetup   bool `json:"two_factor_setup"`
+}
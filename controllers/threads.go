@@ -6,8 +6,10 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/noamdb/modernboard/cache"
 	"gitlab.com/noamdb/modernboard/media"
@@ -19,6 +21,7 @@ type ThreadsResource struct {
 	Repo         *repository.Repository
 	ThreadsPageC *cache.ThreadsPageCache
 	ThreadCacheC *cache.ThreadCache
+	MediaQ       *media.Queue
 }
 
 func (rs ThreadsResource) ThreadsRoutes() chi.Router {
@@ -30,7 +33,7 @@ func (rs ThreadsResource) ThreadsRoutes() chi.Router {
 	})
 	r.Post(`/`, rs.Create)
 	r.Group(func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.JANITOR))
+		r.Use(Require(rs.Repo, utils.Moderate))
 		r.Use(paginate)
 		r.Get("/manage", rs.ListManage)
 	})
@@ -42,15 +45,29 @@ func (rs ThreadsResource) ThreadRoutes() chi.Router {
 
 	r.Get(`/`, rs.Get)
 	r.Group(func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.JANITOR))
+		r.Use(Require(rs.Repo, utils.Moderate))
 		r.Get("/manage", rs.GetManage)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.DeletePost))
 		r.Delete("/", rs.Delete)
 	})
 	r.Group(func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.MOD))
+		r.Use(Require(rs.Repo, utils.Sticky))
 		r.Post("/stick", rs.ToggleSticky)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.Lock))
 		r.Post("/lock", rs.ToggleLock)
 	})
+	r.Group(func(r chi.Router) {
+		r.Use(Require(rs.Repo, utils.ManageThreads))
+		r.Post("/autosage", rs.ToggleAutosage)
+		r.Post("/cycle", rs.ToggleCyclical)
+		r.Post("/move", rs.Move)
+		r.Post("/merge", rs.Merge)
+		r.Post("/split", rs.Split)
+	})
 
 	return r
 }
@@ -84,15 +101,26 @@ func (rs ThreadsResource) Create(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
 	r.ParseMultipartForm(10 << 20)
 	tc := threadCreate{boardURI: chi.URLParam(r, "boardURI"),
-		subject:  r.PostFormValue("subject"),
-		author:   r.PostFormValue("author"),
-		tripcode: r.PostFormValue("tripcode"),
-		body:     r.PostFormValue("body")}
+		subject: r.PostFormValue("subject"),
+		author:  utils.ParseAuthor(r.PostFormValue("author"), r.PostFormValue("tripcode")),
+		body:    r.PostFormValue("body"),
+		poll:    pollFromForm(r)}
 	if !tc.valid() {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	board, err := rs.Repo.GetBoard(tc.boardURI)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	capcode, ok := verifiedCapcode(rs.Repo, r, tc.author.Capcode, board.ID)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	file, handler, err := r.FormFile("file")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -100,7 +128,7 @@ func (rs ThreadsResource) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	fileName, thumbnailName, err := media.HandleFile(file, 250)
+	fi, err := media.HandleFile(file, board.AllowedTypes)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "create thread",
@@ -109,21 +137,27 @@ func (rs ThreadsResource) Create(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	ti := repository.ThreadInsert{BoardURI: tc.boardURI, Subject: tc.subject}
+	fileName, thumbnailName := fi.Name, fi.ThumbnailName
+	ti := repository.ThreadInsert{BoardURI: tc.boardURI, Subject: tc.subject, Poll: tc.poll}
 	if len(handler.Filename) > 50 {
 		handler.Filename = handler.Filename[:50]
 	}
-	html, _ := utils.HTMLAndReplies(tc.body)
+	html, replies := renderBody(rs.Repo, board, tc.body)
 
-	pi := repository.PostInsert{Author: tc.author,
-		Tripcode: utils.EncryptString(tc.tripcode),
+	pi := repository.PostInsert{Author: tc.author.Name,
+		Tripcode: tc.author.Tripcode,
+		Capcode:  capcode,
 		Body:     tc.body, BodyHTML: html,
 		FileName: fileName, FileOriginalName: handler.Filename,
 		ThumbnailName: thumbnailName, Bump: true,
+		FileSpoiler:     r.PostFormValue("spoiler") == "true",
+		FileContentType: fi.ContentType,
+		FileMetadata:    fileMetadata(fi),
+		Replies:         pq.Int64Array(replies),
 	}
 	pi.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
 
-	threadID, err := rs.Repo.CreateThread(ti, pi)
+	threadID, _, jobID, err := rs.Repo.CreateThread(ti, pi)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "create thread",
@@ -131,10 +165,34 @@ func (rs ThreadsResource) Create(w http.ResponseWriter, r *http.Request) {
 		}).Error("could not save thread in db")
 		media.DeleteFileAndThumbnail(fileName, thumbnailName)
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	rs.MediaQ.Notify()
 	json.NewEncoder(w).Encode(struct {
-		ID int `json:"id"`
-	}{threadID})
+		ID    int `json:"id"`
+		JobID int `json:"job_id,omitempty"`
+	}{threadID, jobID})
+}
+
+// pollFromForm returns the poll of the new thread or nil if the thread has no poll,
+// poll_closes is an optional RFC 3339 time
+func pollFromForm(r *http.Request) *repository.PollInsert {
+	question := r.PostFormValue("poll_question")
+	if question == "" {
+		return nil
+	}
+	poll := &repository.PollInsert{Question: question,
+		Multiple: r.PostFormValue("poll_multiple") == "true",
+		Options:  r.PostForm["poll_options"]}
+	if closes := r.PostFormValue("poll_closes"); closes != "" {
+		t, err := time.Parse(time.RFC3339, closes)
+		if err != nil {
+			// an invalid closing time makes the poll invalid
+			t = time.Time{}
+		}
+		poll.Closes = &t
+	}
+	return poll
 }
 
 func (rs ThreadsResource) ListManage(w http.ResponseWriter, r *http.Request) {
@@ -239,3 +297,140 @@ func (rs ThreadsResource) ToggleLock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (rs ThreadsResource) ToggleAutosage(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+
+	err := rs.Repo.ToggleAutosage(threadID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "toggle autosage",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not toggle autosage")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (rs ThreadsResource) ToggleCyclical(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+
+	err := rs.Repo.ToggleCyclical(threadID,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "toggle cyclical",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not toggle cyclical")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (rs ThreadsResource) Move(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+	m := &ThreadMove{}
+	err := json.NewDecoder(r.Body).Decode(m)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !m.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tm := repository.ThreadMove{ThreadID: threadID, BoardURI: m.BoardURI}
+	if m.Redirect {
+		tm.StubBody = fmt.Sprintf("Thread moved to /%s/", m.BoardURI)
+		tm.StubBodyHTML, _ = utils.HTMLAndReplies(tm.StubBody, nil, utils.Markup{})
+	}
+	from, to, err := rs.Repo.MoveThread(tm,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "move thread",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not move thread")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+	rs.ThreadsPageC.DeleteBoard(from)
+	rs.ThreadsPageC.DeleteBoard(to)
+}
+
+// Merge moves the posts of the thread into another thread
+func (rs ThreadsResource) Merge(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+	m := &ThreadMerge{}
+	err := json.NewDecoder(r.Body).Decode(m)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !m.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	target, err := rs.Repo.GetThreadBoard(m.ThreadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tm := repository.ThreadMerge{ThreadID: threadID, TargetID: m.ThreadID,
+		StubBody: fmt.Sprintf("Thread merged into a thread of /%s/", target.Uri)}
+	tm.StubBodyHTML, _ = utils.HTMLAndReplies(tm.StubBody, nil, utils.Markup{})
+	from, to, err := rs.Repo.MergeThreads(tm,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "merge thread",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not merge thread")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+	rs.ThreadCacheC.DeleteThread(m.ThreadID)
+	rs.ThreadsPageC.DeleteBoard(from)
+	rs.ThreadsPageC.DeleteBoard(to)
+}
+
+// Split moves the post and the posts after it into a new thread
+func (rs ThreadsResource) Split(w http.ResponseWriter, r *http.Request) {
+	threadID, _ := strconv.Atoi(chi.URLParam(r, "threadID"))
+	s := &ThreadSplit{}
+	err := json.NewDecoder(r.Body).Decode(s)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	newThreadID, boardURI, err := rs.Repo.SplitThread(threadID, s.PostID, s.Subject,
+		r.Context().Value("user").(repository.User).Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "split thread",
+			"error":     err,
+			"thread_id": threadID,
+		}).Error("could not split thread")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.ThreadCacheC.DeleteThread(threadID)
+	rs.ThreadsPageC.DeleteBoard(boardURI)
+	json.NewEncoder(w).Encode(struct {
+		ID int `json:"id"`
+	}{newThreadID})
+}
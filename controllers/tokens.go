@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/noamdb/modernboard/repository"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+// Tokens lists the API tokens of the user
+func (rs UsersResource) Tokens(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+
+	tokens, err := rs.Repo.GetAPITokens(user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "list api tokens",
+			"error": err,
+		}).Error("could not list api tokens")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateToken creates an API token with capabilities and boards of the user,
+// the token is returned only once
+func (rs UsersResource) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+	tc := &APITokenCreate{}
+	err := json.NewDecoder(r.Body).Decode(tc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !tc.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, c := range tc.Capabilities {
+		if !utils.HasCapability(user.Capabilities, c) && len(user.BoardsWith(c)) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	boards := pq.Int64Array{}
+	for _, uri := range tc.Boards {
+		found := false
+		for _, b := range user.BoardCapabilities {
+			if b.BoardURI == uri {
+				boards = append(boards, b.BoardID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	token, err := utils.NewAPIToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ti := repository.APITokenInsert{UserID: user.ID, Name: tc.Name, TokenHash: utils.HashAPIToken(token),
+		Capabilities: pq.StringArray(tc.Capabilities), Boards: boards}
+	if tc.ExpiresDays > 0 {
+		expires := time.Now().Add(time.Duration(tc.ExpiresDays) * 24 * time.Hour)
+		ti.Expires = &expires
+	}
+	tokenID, err := rs.Repo.CreateAPIToken(ti)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "create api token",
+			"error": err,
+		}).Error("could not create api token")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs.audit(r, repository.AuditTokenCreated, user.ID, tokenID)
+	json.NewEncoder(w).Encode(struct {
+		ID    int    `json:"id"`
+		Token string `json:"token"`
+	}{tokenID, token})
+}
+
+// DeleteToken revokes an API token of the user
+func (rs UsersResource) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, _ := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	user := r.Context().Value("user").(repository.User)
+
+	err := rs.Repo.DeleteAPIToken(user.ID, tokenID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":    "delete api token",
+			"error":    err,
+			"token_id": tokenID,
+		}).Error("could not delete api token")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the token is deleted so the entry can't refer to it
+	rs.audit(r, repository.AuditTokenDeleted, user.ID, 0)
+}
+
+// audit records an event of the user of the request
+func (rs UsersResource) audit(r *http.Request, event string, userID int, tokenID int) {
+	ai := repository.AuditInsert{Event: event, UserID: userID, TokenID: tokenID}
+	ai.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if err := rs.Repo.InsertAudit(ai); err != nil {
+		log.WithFields(log.Fields{
+			"event": "audit",
+			"error": err,
+		}).Error("could not record audit event", event)
+	}
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gitlab.com/noamdb/modernboard/repository"
+	"gitlab.com/noamdb/modernboard/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// twoFactorLoginTime is the time to enter the 2FA code after the password
+	twoFactorLoginTime = 5 * time.Minute
+	// twoFactorAttempts is the number of wrong codes after which the login starts over
+	twoFactorAttempts  = 5
+	recoveryCodesCount = 10
+)
+
+// LoginTwoFactor is the second step of the login of users with 2FA,
+// it verifies a TOTP code or a recovery code for the session of the first step
+func (rs UsersResource) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	c := &TwoFactorCode{}
+	err = json.NewDecoder(r.Body).Decode(c)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !c.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	login, err := rs.Repo.GetTwoFactorLogin(cookie.Value)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// the failed logins were reset after the password, the wrong codes
+	// are limited by the attempts of the session
+	if !rs.checkTwoFactor(login.UserID, login.TOTPSecret, *c) {
+		if err := rs.Repo.FailTwoFactorLogin(login.SessionID, twoFactorAttempts); err != nil {
+			log.WithFields(log.Fields{
+				"event": "2fa login",
+				"error": err,
+			}).Error("could not count failed 2fa attempt")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	expires := sessionExpiry()
+	err = rs.Repo.VerifyTwoFactorLogin(login.SessionID, expires)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "2fa login",
+			"error": err,
+		}).Error("could not verify session")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, sessionCookie(cookie.Value, expires))
+	json.NewEncoder(w).Encode(UserLoginResponse{ID: login.UserID, Role: login.Role})
+}
+
+// checkTwoFactor is true if the code is a valid TOTP code that wasn't used before or an unused recovery code
+func (rs UsersResource) checkTwoFactor(userID int, secret string, c TwoFactorCode) bool {
+	if c.RecoveryCode != "" {
+		return rs.Repo.UseRecoveryCode(userID, utils.HashRecoveryCode(c.RecoveryCode)) == nil
+	}
+	period, ok := utils.CheckTOTP(secret, c.Code, time.Now())
+	return ok && rs.Repo.UseTOTPPeriod(userID, period) == nil
+}
+
+// EnrollTwoFactor creates a new secret for the user and returns it with its otpauth URI for a QR code,
+// 2FA is enabled after a code of the secret is verified
+func (rs UsersResource) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = rs.Repo.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "enroll 2fa",
+			"error": err,
+		}).Error("could not set totp secret")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, utils.TOTPURI(viper.GetString("domain"), user.Name, secret)})
+}
+
+// VerifyTwoFactor enables 2FA with a code of the enrolled secret and returns
+// the recovery codes, they are shown only once
+func (rs UsersResource) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+	c := &TwoFactorCode{}
+	err := json.NewDecoder(r.Body).Decode(c)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	secret, err := rs.Repo.GetTOTPSecret(user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "verify 2fa",
+			"error": err,
+		}).Error("could not get totp secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	period, ok := utils.CheckTOTP(secret, c.Code, time.Now())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	codes, err := utils.NewRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	hashes := make(pq.StringArray, len(codes))
+	for i, code := range codes {
+		hashes[i] = utils.HashRecoveryCode(code)
+	}
+	err = rs.Repo.EnableTwoFactor(user.ID, period, hashes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "verify 2fa",
+			"error": err,
+		}).Error("could not enable 2fa")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+// DisableTwoFactor disables 2FA of the user after the password is verified
+func (rs UsersResource) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+	d := &TwoFactorDisable{}
+	err := json.NewDecoder(r.Body).Decode(d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(d.Password)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = rs.Repo.DisableTwoFactor(user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "disable 2fa",
+			"error": err,
+		}).Error("could not disable 2fa")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// ResetTwoFactor disables 2FA of a user that lost the authenticator and the recovery codes,
+// the user is logged out everywhere and the tokens of the user are deleted
+func (rs UsersResource) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
+	user := r.Context().Value("user").(repository.User)
+
+	ai := repository.AuditInsert{Event: repository.AuditTwoFactorReset, UserID: userID, ActorID: user.ID}
+	ai.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	err := rs.Repo.ResetTwoFactor(ai)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "reset 2fa",
+			"error":   err,
+			"user_id": userID,
+		}).Error("could not reset 2fa")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
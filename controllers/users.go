@@ -2,13 +2,17 @@ package controllers
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/utils"
 	"golang.org/x/crypto/bcrypt"
@@ -21,28 +25,46 @@ type UsersResource struct {
 func (rs *UsersResource) Routes() chi.Router {
 	r := chi.NewRouter()
 	r.Route(`/register`, func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.ADMIN))
+		r.Use(Require(rs.Repo, utils.ManageUsers))
 		r.Post(`/`, rs.Register)
 	})
-	r.Route(`/changePassword`, func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.JANITOR))
-		r.Post(`/`, rs.ChangePassword)
+	r.Group(func(r chi.Router) {
+		r.Use(Authenticate(rs.Repo))
+		r.Post(`/changePassword`, rs.ChangePassword)
+		r.Get(`/me`, rs.Me)
+		r.Get(`/sessions`, rs.Sessions)
+		r.Delete(`/sessions`, rs.LogoutEverywhere)
+		r.Delete(`/sessions/{sessionID:[0-9]+}`, rs.DeleteSession)
+		r.Post(`/2fa`, rs.EnrollTwoFactor)
+		r.Post(`/2fa/verify`, rs.VerifyTwoFactor)
+		r.Delete(`/2fa`, rs.DisableTwoFactor)
+		r.Get(`/tokens`, rs.Tokens)
+		r.Post(`/tokens`, rs.CreateToken)
+		r.Delete(`/tokens/{tokenID:[0-9]+}`, rs.DeleteToken)
 	})
 	r.Post(`/login`, rs.Login)
+	r.Post(`/login/2fa`, rs.LoginTwoFactor)
 	r.Post(`/logout`, rs.Logout)
 	r.Group(func(r chi.Router) {
-		r.Use(Authorize(rs.Repo, utils.ADMIN))
+		r.Use(Require(rs.Repo, utils.ManageUsers))
 		r.Get(`/`, rs.list)
 		r.Delete(`/{userID:[0-9]+}`, rs.deleteUser)
+		r.Delete(`/{userID:[0-9]+}/2fa`, rs.ResetTwoFactor)
+		r.Post(`/{userID:[0-9]+}/unlock`, rs.Unlock)
+		r.Route(`/audit`, func(r chi.Router) {
+			r.Use(paginate)
+			r.Get(`/`, rs.AuditLog)
+		})
 	})
 	return r
 }
 
 func (rs *UsersResource) BoardRoutes() chi.Router {
 	r := chi.NewRouter()
-	r.Use(Authorize(rs.Repo, utils.ADMIN))
+	r.Use(Require(rs.Repo, utils.ManageBoardUsers))
 	r.Get(`/`, rs.ListBoardUsers)
 	r.Post(`/`, rs.createBoardUser)
+	r.Put(`/{userID:[0-9]+}`, rs.UpdateBoardUser)
 	r.Delete(`/{userID:[0-9]+}`, rs.DeleteBoardUser)
 	return r
 }
@@ -85,19 +107,42 @@ func (rs UsersResource) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	IP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	locked, ok := rs.reserveLogin(w, IP, user.Name)
+	if !ok {
+		return
+	}
+
 	savedUser, err := rs.Repo.GetUser(user.Name)
 	if err != nil {
+		// compare anyway so unknown names take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(user.Password))
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(savedUser.Password), []byte(user.Password)); err != nil {
+		if locked {
+			rs.audit(r, repository.AuditAccountLocked, savedUser.ID, 0)
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	// the password is right, with 2FA the code is limited by the attempts of the session
+	rs.resetLogin(IP, user.Name)
 
-	uuid := uuid.Must(uuid.NewV4()).String()
+	// with 2FA the session is only for the second step until the code is verified
+	si := repository.SessionInsert{Token: uuid.Must(uuid.NewV4()).String(), UserID: savedUser.ID,
+		UserAgent: r.UserAgent(), Expires: sessionExpiry(),
+		TwoFactorPending: savedUser.TwoFactorEnabled}
+	if si.TwoFactorPending {
+		si.Expires = time.Now().Add(twoFactorLoginTime)
+	}
+	if len(si.UserAgent) > 300 {
+		si.UserAgent = strings.ToValidUTF8(si.UserAgent[:300], "")
+	}
+	si.IP = IP
 
-	err = rs.Repo.CreateSession(uuid, user.Name)
+	err = rs.Repo.CreateSession(si)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"event": "create session",
@@ -107,14 +152,98 @@ func (rs UsersResource) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie := http.Cookie{Name: "session", Value: uuid, Path: "/",
-		Expires: time.Now().Add(10 * 24 * time.Hour), HttpOnly: true}
-	http.SetCookie(w, &cookie)
-	res := UserLoginResponse{ID: savedUser.ID, Role: savedUser.Role}
+	http.SetCookie(w, sessionCookie(si.Token, si.Expires))
+	if si.TwoFactorPending {
+		json.NewEncoder(w).Encode(UserLoginResponse{TwoFactorPending: true})
+		return
+	}
+	res := UserLoginResponse{ID: savedUser.ID, Role: savedUser.Role,
+		TwoFactorSetup: savedUser.TwoFactorRequired}
 	json.NewEncoder(w).Encode(res)
 
 }
 
+// dummyHash is compared with the password of logins of unknown users
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// loginPolicy is the backoff and lockout of failed logins from the config
+func loginPolicy() repository.LoginPolicy {
+	return repository.LoginPolicy{
+		FreeAttempts:    viper.GetInt("login_free_attempts"),
+		MaxDelay:        viper.GetInt("login_max_delay_seconds"),
+		LockoutAttempts: viper.GetInt("login_lockout_attempts"),
+		LockoutMinutes:  viper.GetInt("login_lockout_minutes"),
+	}
+}
+
+// reserveLogin counts the login attempt of the IP and the name before the password is checked,
+// it writes the response and is false if the attempt is blocked.
+// locked is true if the attempt locked the name
+func (rs UsersResource) reserveLogin(w http.ResponseWriter, IP string, name string) (bool, bool) {
+	retryAfter, locked, err := rs.Repo.ReserveLogin(IP, name, loginPolicy())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "login",
+			"error": err,
+		}).Error("could not reserve login attempt")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false, false
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false, false
+	}
+	return locked, true
+}
+
+func (rs UsersResource) resetLogin(IP string, name string) {
+	if err := rs.Repo.ResetLogin(IP, name); err != nil {
+		log.WithFields(log.Fields{
+			"event": "login",
+			"error": err,
+		}).Error("could not reset failed logins")
+	}
+}
+
+// Unlock unblocks the login of a user that was locked after failed logins
+func (rs UsersResource) Unlock(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
+	user := r.Context().Value("user").(repository.User)
+
+	ai := repository.AuditInsert{Event: repository.AuditAccountUnlocked, UserID: userID, ActorID: user.ID}
+	ai.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	err := rs.Repo.UnlockUser(ai)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":   "unlock user",
+			"error":   err,
+			"user_id": userID,
+		}).Error("could not unlock user")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// AuditLog lists the security events of the users from the newest
+func (rs UsersResource) AuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := rs.Repo.GetAuditLog(r.Context().Value("page").(int))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "audit log",
+			"error": err,
+		}).Error("could not get audit log")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// sessionExpiry is the absolute expiry of a new session
+func sessionExpiry() time.Time {
+	return time.Now().Add(time.Duration(viper.GetInt("session_days")) * 24 * time.Hour)
+}
+
 func (rs UsersResource) Logout(w http.ResponseWriter, r *http.Request) {
 	session, err := r.Cookie("session")
 	if err == nil {
@@ -125,10 +254,70 @@ func (rs UsersResource) Logout(w http.ResponseWriter, r *http.Request) {
 			}).Error("could not delete session")
 		}
 	}
-	cookie := &http.Cookie{Name: "session", Value: "", Expires: time.Unix(0, 0),
-		Path: "/", HttpOnly: true,
+	http.SetCookie(w, sessionCookie("", time.Unix(0, 0)))
+}
+
+// sessionCookie is sent only over HTTPS and only to the site itself in production
+func sessionCookie(token string, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{Name: "session", Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if viper.GetString("environment") == "production" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteStrictMode
 	}
-	http.SetCookie(w, cookie)
+	return cookie
+}
+
+// Sessions lists the sessions of the user
+func (rs UsersResource) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+
+	sessions, err := rs.Repo.GetSessions(user.ID, user.SessionID, viper.GetInt("session_idle_hours"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "list sessions",
+			"error": err,
+		}).Error("could not list sessions")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// DeleteSession revokes a session of the user
+func (rs UsersResource) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	user := r.Context().Value("user").(repository.User)
+
+	err := rs.Repo.DeleteUserSession(user.ID, sessionID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":      "delete session",
+			"error":      err,
+			"session_id": sessionID,
+		}).Error("could not delete session")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if sessionID == user.SessionID {
+		http.SetCookie(w, sessionCookie("", time.Unix(0, 0)))
+	}
+}
+
+// LogoutEverywhere revokes all the sessions of the user, including the current session
+func (rs UsersResource) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+
+	err := rs.Repo.DeleteUserSessions(user.ID, 0)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "delete sessions",
+			"error": err,
+		}).Error("could not delete sessions")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, sessionCookie("", time.Unix(0, 0)))
 }
 
 func (rs UsersResource) ChangePassword(w http.ResponseWriter, r *http.Request) {
@@ -159,6 +348,15 @@ func (rs UsersResource) ChangePassword(w http.ResponseWriter, r *http.Request) {
 			"error": err,
 		}).Error("could not change password")
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// other sessions may be of someone who knew the old password
+	err = rs.Repo.DeleteUserSessions(u.ID, u.SessionID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": "change password",
+			"error": err,
+		}).Error("could not delete other sessions")
 	}
 }
 
@@ -263,3 +461,59 @@ func (rs UsersResource) DeleteBoardUser(w http.ResponseWriter, r *http.Request)
 	}
 
 }
+
+// Me returns the capabilities of the user on the boards of the user
+func (rs UsersResource) Me(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(repository.User)
+	json.NewEncoder(w).Encode(UserPermissions{ID: user.ID, Name: user.Name, Role: user.Role,
+		Capabilities: user.Capabilities, Boards: user.BoardCapabilities,
+		TwoFactorEnabled: user.TwoFactorEnabled, TwoFactorSetup: user.NeedsTwoFactor()})
+}
+
+// UpdateBoardUser sets the capabilities that are granted and revoked on the board,
+// users can only grant capabilities they have on the board and can't change their own capabilities
+func (rs UsersResource) UpdateBoardUser(w http.ResponseWriter, r *http.Request) {
+	boardURI := chi.URLParam(r, "boardURI")
+	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
+	user := r.Context().Value("user").(repository.User)
+
+	if user.ID == userID {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	bo := &repository.BoardOverrides{}
+	err := json.NewDecoder(r.Body).Decode(bo)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !bo.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	caps := user.BoardCapabilitiesOf(boardURI)
+	for _, c := range bo.Granted {
+		if !utils.HasCapability(caps, c) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if bo.Granted == nil {
+		bo.Granted = pq.StringArray{}
+	}
+	if bo.Revoked == nil {
+		bo.Revoked = pq.StringArray{}
+	}
+	err = rs.Repo.UpdateBoardUser(boardURI, userID, *bo, user.Boards)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":     "update board user",
+			"error":     err,
+			"board_uri": boardURI,
+			"user_id":   userID,
+		}).Error("could not update board user")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
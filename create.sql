@@ -6,33 +6,120 @@ DROP SCHEMA public CASCADE;
 CREATE SCHEMA public;
 -- drop tables
 
-CREATE TYPE role AS ENUM ('admin', 'mod', 'janitor');
+-- roles are editable bundles of the capabilities of utils/permission.go
+CREATE TABLE IF NOT EXISTS roles(
+  name TEXT PRIMARY KEY NOT NULL CONSTRAINT name_check CHECK (length(name) <= 20),
+  capabilities TEXT[] NOT NULL DEFAULT '{}',
+  -- the capabilities apply to every board, not only to the boards of the user
+  all_boards BOOLEAN NOT NULL DEFAULT false,
+  -- users of the role can only manage their own account until they enable 2FA
+  require_2fa BOOLEAN NOT NULL DEFAULT false,
+  created TIMESTAMPTZ NOT NULL
+);
+
+INSERT INTO roles (name, capabilities, all_boards, created) VALUES
+('admin', '{delete_post,ban,ban_range,sticky,lock,manage_threads,edit_post,moderate,manage_board_users,poster_history,view_ip,manage_filters,manage_boards,manage_users,capcode}', true, current_timestamp),
+('mod', '{delete_post,ban,ban_range,sticky,lock,manage_threads,edit_post,moderate,poster_history,capcode}', false, current_timestamp),
+('janitor', '{delete_post,moderate}', false, current_timestamp);
 
 CREATE TABLE IF NOT EXISTS users(
   id   SERIAL PRIMARY KEY NOT NULL,
   name TEXT UNIQUE NOT NULL CONSTRAINT name_check CHECK  (length(name) <= 30),
   password TEXT NOT NULL CONSTRAINT password_check CHECK  (length(password) <= 300),
-  role role NOT NULL,
+  role TEXT NOT NULL REFERENCES roles ON UPDATE CASCADE,
+  -- base32 TOTP secret, it's used for login after a code of it was verified
+  totp_secret TEXT NOT NULL DEFAULT '',
+  totp_enabled BOOLEAN NOT NULL DEFAULT false,
+  -- the period of the last used code, codes of earlier periods can't be used
+  totp_last_period BIGINT NOT NULL DEFAULT 0,
+  -- hashes of the unused recovery codes
+  recovery_codes TEXT[] NOT NULL DEFAULT '{}',
   created TIMESTAMPTZ NOT NULL
   );
 
-CREATE TABLE IF NOT EXISTS sessions(
-  id   TEXT PRIMARY KEY NOT NULL,
+-- failed logins of IPs and of the names they were sent with, by a hash of the IP or the name.
+-- the count starts over an hour after the last failure
+CREATE TABLE IF NOT EXISTS login_attempts(
+  key_hash TEXT PRIMARY KEY NOT NULL,
+  failures INTEGER NOT NULL,
+  last_failure TIMESTAMPTZ NOT NULL,
+  blocked_until TIMESTAMPTZ NOT NULL,
+  -- the name is locked until blocked_until after login_lockout_attempts failures
+  locked BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens(
+  id SERIAL PRIMARY KEY NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+  name TEXT NOT NULL CONSTRAINT name_check CHECK (length(name) <= 50),
+  -- SHA-256 of the token, the token is shown only when it's created
+  token_hash TEXT UNIQUE NOT NULL,
+  -- the token has only these capabilities of the user
+  capabilities TEXT[] NOT NULL,
+  -- the token is limited to these boards of the user, all the boards of the user if it's empty
+  boards INTEGER[] NOT NULL DEFAULT '{}',
+  -- the token never expires if it's null
+  expires TIMESTAMPTZ,
+  last_used TIMESTAMPTZ,
+  created TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_log(
+  id SERIAL PRIMARY KEY NOT NULL,
+  event TEXT NOT NULL CONSTRAINT event_check CHECK (length(event) <= 50),
+  -- the user the event is about
   user_id INTEGER REFERENCES users ON DELETE CASCADE,
+  -- the user that did the action, if it isn't the user of the event
+  actor_id INTEGER REFERENCES users ON DELETE SET NULL,
+  -- the API token the action was done with
+  token_id INTEGER REFERENCES api_tokens ON DELETE SET NULL,
+  ip inet,
   created TIMESTAMPTZ NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS sessions(
+  id   SERIAL PRIMARY KEY NOT NULL,
+  -- the value of the session cookie, the id is shown to the user instead
+  token TEXT UNIQUE NOT NULL,
+  user_id INTEGER REFERENCES users ON DELETE CASCADE,
+  user_agent TEXT NOT NULL DEFAULT '' CONSTRAINT user_agent_check CHECK (length(user_agent) <= 300),
+  ip inet,
+  created TIMESTAMPTZ NOT NULL,
+  last_seen TIMESTAMPTZ NOT NULL,
+  -- the session also expires when it isn't used for session_idle_hours
+  expires TIMESTAMPTZ NOT NULL,
+  -- the password was verified and the login waits for the 2FA code
+  two_factor_pending BOOLEAN NOT NULL DEFAULT false,
+  two_factor_attempts INTEGER NOT NULL DEFAULT 0
+);
+
 CREATE TABLE IF NOT EXISTS boards
 (
   id   SERIAL PRIMARY KEY NOT NULL,
   uri TEXT UNIQUE NOT NULL CONSTRAINT uri_check CHECK (length(uri) <= 10),
   title TEXT UNIQUE NOT NULL CONSTRAINT title_check CHECK (length(title) <= 20),
-  priority INTEGER NOT NULL
+  priority INTEGER NOT NULL,
+  poster_ids BOOLEAN NOT NULL DEFAULT false,
+  -- replies after the bump limit don't bump the thread
+  bump_limit INTEGER NOT NULL DEFAULT 300 CONSTRAINT bump_limit_check CHECK (bump_limit > 0),
+  -- markup extensions of the posts
+  greentext BOOLEAN NOT NULL DEFAULT true,
+  spoilers BOOLEAN NOT NULL DEFAULT true,
+  code_blocks BOOLEAN NOT NULL DEFAULT true,
+  math BOOLEAN NOT NULL DEFAULT false,
+  nsfw BOOLEAN NOT NULL DEFAULT false,
+  -- extensions of the file types that can be uploaded
+  allowed_types TEXT[] NOT NULL DEFAULT '{jpg,png,gif,webm}',
+  -- the original names of the uploaded files are not shown
+  hide_file_names BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE IF NOT EXISTS users_boards(
   user_id INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
   board_id INTEGER NOT NULL REFERENCES boards ON DELETE CASCADE,
+  -- per board overrides of the capabilities of the role of the user
+  granted TEXT[] NOT NULL DEFAULT '{}',
+  revoked TEXT[] NOT NULL DEFAULT '{}',
   created TIMESTAMPTZ NOT NULL,
   CONSTRAINT users_boards_pkey PRIMARY KEY (user_id, board_id)
 );
@@ -44,6 +131,14 @@ CREATE TABLE IF NOT EXISTS threads
   subject TEXT NOT NULL CONSTRAINT subject_check CHECK (length(subject) <= 300),
   is_sticky boolean NOT NULL,
   is_locked boolean NOT NULL,
+  -- replies to autosaged threads never bump
+  is_autosage boolean NOT NULL DEFAULT false,
+  -- the oldest replies of cyclical threads are pruned after the posts limit
+  is_cyclical boolean NOT NULL DEFAULT false,
+  -- set on threads that were moved or merged into another thread
+  moved_to INTEGER REFERENCES threads ON DELETE SET NULL,
+  -- the rotation period of the poster ID key when the thread was created
+  poster_id_epoch BIGINT NOT NULL DEFAULT 0,
   deleted BOOLEAN
 );
 
@@ -55,17 +150,69 @@ CREATE TABLE IF NOT EXISTS posts
   body TEXT CONSTRAINT body_check CHECK (length(body) <= 50000),
   body_html TEXT CONSTRAINT body_html_check CHECK (length(body_html) <= 80000),
   tripcode TEXT CONSTRAINT tripcode_check CHECK (length(tripcode) <= 20),
-  ip inet NOT NULL,
+  -- role badge of staff posts
+  capcode TEXT NOT NULL DEFAULT '' CONSTRAINT capcode_check CHECK (length(capcode) <= 20),
+  -- removed after ip_retention_days
+  ip inet,
   author_id TEXT NOT NULL,
+  -- per thread ID of the poster, can't be linked across threads
+  poster_id TEXT NOT NULL,
   bump boolean NOT NULL,
   created TIMESTAMPTZ NOT NULL,
   file_name TEXT CONSTRAINT file_name_check CHECK (length(file_name) <= 200),
   file_original_name TEXT CONSTRAINT file_original_name_check CHECK  (length(file_original_name) <= 200),
   thumbnail_name TEXT CONSTRAINT thumbnail_name_check CHECK  (length(file_name) <= 200),
+  -- the thumbnail is hidden behind the spoiler thumbnail
+  file_spoiler BOOLEAN NOT NULL DEFAULT false,
+  file_size BIGINT NOT NULL DEFAULT 0,
+  file_width INTEGER NOT NULL DEFAULT 0,
+  file_height INTEGER NOT NULL DEFAULT 0,
+  -- seconds of videos
+  file_duration REAL NOT NULL DEFAULT 0,
+  thumbnail_width INTEGER NOT NULL DEFAULT 0,
+  thumbnail_height INTEGER NOT NULL DEFAULT 0,
+  -- the thumbnail and the metadata of the file are being created by a media job
+  file_processing BOOLEAN NOT NULL DEFAULT false,
+  -- the body was edited by staff
+  is_edited BOOLEAN NOT NULL DEFAULT false,
+  -- the first post of the thread, it stays first when older posts are merged into the thread
+  is_op BOOLEAN NOT NULL DEFAULT false,
   deleted BOOLEAN
   -- size DECIMAL(2, 2) NOT NULL,
 );
 
+-- the original name of a file is looked up by the name of the file when it is downloaded
+CREATE INDEX IF NOT EXISTS posts_file_name_idx ON posts (file_name);
+-- the poster history finds the posts of the IP or of the author ID of a post
+CREATE INDEX IF NOT EXISTS posts_author_id_idx ON posts (author_id);
+CREATE INDEX IF NOT EXISTS posts_ip_idx ON posts (ip);
+
+CREATE TABLE IF NOT EXISTS media_jobs
+(
+  id SERIAL PRIMARY KEY NOT NULL,
+  post_id INTEGER NOT NULL REFERENCES posts ON DELETE CASCADE,
+  kind TEXT NOT NULL CONSTRAINT kind_check CHECK (kind IN ('thumbnail', 'transcode')),
+  status TEXT NOT NULL CONSTRAINT status_check CHECK (status IN ('pending', 'running', 'done', 'failed')),
+  file_name TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  -- pending jobs are not claimed before this time, used to delay retries
+  run_after TIMESTAMPTZ NOT NULL,
+  created TIMESTAMPTZ NOT NULL,
+  updated TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS post_revisions
+(
+  id SERIAL PRIMARY KEY NOT NULL,
+  post_id INTEGER NOT NULL REFERENCES posts ON DELETE CASCADE,
+  editor_id INTEGER REFERENCES users ON DELETE SET NULL,
+  previous_body TEXT NOT NULL,
+  body TEXT NOT NULL,
+  created TIMESTAMPTZ NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS replies
 (
   post_id int REFERENCES posts ON DELETE CASCADE,
@@ -73,16 +220,73 @@ CREATE TABLE IF NOT EXISTS replies
   PRIMARY KEY (post_id, reply_id)
 );
 
+CREATE TABLE IF NOT EXISTS polls
+(
+  id SERIAL PRIMARY KEY NOT NULL,
+  thread_id INTEGER UNIQUE NOT NULL REFERENCES threads ON DELETE CASCADE,
+  question TEXT NOT NULL CONSTRAINT question_check CHECK (length(question) <= 200),
+  multiple BOOLEAN NOT NULL,
+  closes TIMESTAMPTZ,
+  is_closed BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS poll_options
+(
+  id SERIAL PRIMARY KEY NOT NULL,
+  poll_id INTEGER NOT NULL REFERENCES polls ON DELETE CASCADE,
+  text TEXT NOT NULL CONSTRAINT text_check CHECK (length(text) <= 100),
+  position INTEGER NOT NULL
+);
+
+-- voter is the hash of the IP, every voter votes once per poll
+CREATE TABLE IF NOT EXISTS poll_voters
+(
+  poll_id INTEGER NOT NULL REFERENCES polls ON DELETE CASCADE,
+  voter TEXT NOT NULL,
+  created TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (poll_id, voter)
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes
+(
+  option_id INTEGER NOT NULL REFERENCES poll_options ON DELETE CASCADE,
+  voter TEXT NOT NULL,
+  PRIMARY KEY (option_id, voter)
+);
+
+CREATE TABLE IF NOT EXISTS report_categories
+(
+  id SERIAL PRIMARY KEY NOT NULL,
+  board_id INTEGER NOT NULL REFERENCES boards ON DELETE CASCADE,
+  name TEXT NOT NULL CONSTRAINT name_check CHECK (length(name) <= 30),
+  weight INTEGER NOT NULL CONSTRAINT weight_check CHECK (weight BETWEEN 1 AND 10),
+  UNIQUE (board_id, name)
+);
+
 CREATE TABLE IF NOT EXISTS reports
 (
   id  SERIAL PRIMARY KEY NOT NULL,
   post_id INTEGER REFERENCES posts ON DELETE CASCADE,
+  category_id INTEGER REFERENCES report_categories ON DELETE SET NULL,
   reason TEXT NOT NULL,
-  ip inet NOT NULL,
+  -- removed after ip_retention_days
+  ip inet,
+  -- keyed hash of the IP, it is kept after the IP is removed
+  reporter_hash TEXT NOT NULL,
   author_id TEXT NOT NULL,
   dismissed BOOLEAN NOT NULL,
+  actioned BOOLEAN NOT NULL DEFAULT false,
   created TIMESTAMPTZ NOT NULL,
-  UNIQUE (post_id, ip)
+  UNIQUE (post_id, reporter_hash)
+);
+
+-- reporters keeps track of how many of the reports sent from an IP were
+-- actioned (the post was deleted) or dismissed by the staff, by the hash of the IP
+CREATE TABLE IF NOT EXISTS reporters
+(
+  reporter_hash TEXT PRIMARY KEY NOT NULL,
+  actioned INTEGER NOT NULL DEFAULT 0,
+  dismissed INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS bans
@@ -10,7 +10,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 
+	"gitlab.com/noamdb/modernboard/cache"
 	"gitlab.com/noamdb/modernboard/config"
+	"gitlab.com/noamdb/modernboard/controllers"
+	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/repository"
 	"gitlab.com/noamdb/modernboard/tasks"
 )
@@ -20,13 +23,16 @@ var initialize bool
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	config.InitConfig()
+	if err := media.InitStorage(); err != nil {
+		log.Fatal(err)
+	}
 
 	flag.BoolVar(&initialize, "init", false, "Initilize app for the first time")
 	flag.Parse()
 
 	repo := &repository.Repository{}
 	repo.Connect(viper.GetString("database_url"))
-	t := tasks.Tasks{repo}
+	t := tasks.Tasks{Repo: repo}
 	t.Run()
 
 	if initialize {
@@ -34,7 +40,13 @@ func main() {
 		return
 	}
 
-	StartServer(repo)
+	c := &cache.Cache{Repository: repo}
+	c.Init()
+	// the media workers run in the background like the tasks, the handlers only enqueue jobs
+	mq := controllers.NewMediaQueue(repo, c.ThreadsPageCache, c.ThreadCache)
+	mq.Start()
+
+	StartServer(repo, c, mq)
 }
 
 func initialRun(repo *repository.Repository) {
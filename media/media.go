@@ -3,6 +3,7 @@ package media
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -21,33 +23,111 @@ import (
 const (
 	filesFolder      = "files/"
 	thumbnailsFolder = "thumbnails/"
+	// uploadsFolder keeps the uploaded files until they are processed and stored,
+	// their thumbnails are created in its thumbnails folder so a WebP upload and
+	// its thumbnail, that have the same name, don't overwrite each other
+	uploadsFolder = "uploads/"
+	thumbnailSize = 250
 )
 
-var validTypes = map[string]string{"image/jpeg": "jpg", "image/png": "png", "video/webm": "webm", "image/gif": "gif"}
+var validTypes = map[string]string{"image/jpeg": "jpg", "image/png": "png", "video/webm": "webm", "image/gif": "gif",
+	"video/mp4": "mp4", "image/webp": "webp", "image/avif": "avif", "audio/mpeg": "mp3", "application/ogg": "ogg",
+	"application/pdf": "pdf"}
 
-func SaveFile(r io.Reader, path string, maxSize int64) (string, string, error) {
+// DefaultExtensions are the file types that are allowed on new boards
+var DefaultExtensions = []string{"jpg", "png", "gif", "webm"}
+
+// ValidExtensions is true if there are extensions and all of them are of supported file types,
+// a board needs at least one type because threads are created with a file
+func ValidExtensions(extensions []string) bool {
+	if len(extensions) == 0 {
+		return false
+	}
+	for _, e := range extensions {
+		found := false
+		for _, ext := range validTypes {
+			if e == ext {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// detectContentType adds AVIF and MP3 files without ID3 tags to http.DetectContentType
+func detectContentType(b []byte) string {
+	if len(b) >= 12 && string(b[4:8]) == "ftyp" {
+		switch string(b[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		}
+	}
+	// MPEG audio layer III frame sync
+	if len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 == 0x02 {
+		return "audio/mpeg"
+	}
+	return http.DetectContentType(b)
+}
+
+// fileNameRegex matches the names that SaveFile gives to the files,
+// the upload date followed by a random number
+var fileNameRegex = regexp.MustCompile(`^[0-9]{9,20}\.[a-z0-9]{3,4}$`)
+
+// ValidFileName is true if the name is the name of an uploaded file or of a thumbnail
+func ValidFileName(name string) bool {
+	return fileNameRegex.MatchString(name) && ContentType(name) != ""
+}
+
+// ContentType is the content type of the file by its extension,
+// or an empty string if it isn't a supported file type
+func ContentType(fileName string) string {
+	ext := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	for ct, e := range validTypes {
+		if e == ext {
+			return ct
+		}
+	}
+	return ""
+}
+
+func allowed(ext string, extensions []string) bool {
+	for _, e := range extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveFile returns the name, the content type and the size of the saved file,
+// the extension of the file type must be one of the allowed extensions
+func SaveFile(r io.Reader, path string, maxSize int64, extensions []string) (string, string, int64, error) {
 	buf := bufio.NewReader(r)
 	sniff, _ := buf.Peek(512)
-	contentType := http.DetectContentType(sniff)
+	contentType := detectContentType(sniff)
 	ext, ok := validTypes[contentType]
-	if !ok {
-		return "", "", errors.New("invalid file type")
+	if !ok || !allowed(ext, extensions) {
+		return "", "", 0, errors.New("invalid file type")
 	}
 	f, err := ioutil.TempFile(path,
 		fmt.Sprintf("%s*.%s", time.Now().Format("20060102"), ext))
 	if err != nil {
-		return "", "", err
+		return "", "", 0, err
 	}
 	defer f.Close()
 	lmt := io.MultiReader(buf, io.LimitReader(r, maxSize-511))
 	written, err := io.Copy(f, lmt)
 	if err != nil && err != io.EOF {
-		return "", "", err
+		return filepath.Base(f.Name()), "", 0, err
 	}
 	if written > maxSize {
-		return "", "", errors.New("surpassed file size limit")
+		return filepath.Base(f.Name()), "", 0, errors.New("surpassed file size limit")
 	}
-	return filepath.Base(f.Name()), contentType, err
+	return filepath.Base(f.Name()), contentType, written, err
 }
 
 func DeleteFile(path string) error {
@@ -65,92 +145,146 @@ func DeleteFile(path string) error {
 	return nil
 }
 
-func CreateThumbnail(contentType string, fileName string, size int) (string, error) {
-	thumbnailName := strings.SplitAfter(fileName, ".")[0] + "webp"
-	thumbnailPath := getThumbnailPath(thumbnailName)
-	var cmd *exec.Cmd
-	if strings.HasPrefix(contentType, "image") {
-		// [0] takes the first frame. usefull for gifs
-		cmd = exec.Command(`gm`, `convert`,
-			`-size`, fmt.Sprintf(`%dx%d`, size, size), getFilePath(fileName)+"[0]",
-			`-resize`, fmt.Sprintf(`%dx%d`, size, size), `+profile`, `"*"`, thumbnailPath)
-	} else {
-		cmd = exec.Command(`ffmpeg`, `-i`, getFilePath(fileName), `-vframes`, `1`, `-vf`,
-			fmt.Sprintf(`scale=w=%d:h=%d:force_original_aspect_ratio=decrease`, size, size),
-			thumbnailPath, `-loglevel`, `error`, `-y`)
-	}
+// runCommand runs the command and fails if it wrote to stderr,
+// the command is killed when the context is done
+func runCommand(ctx context.Context, event string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
 	var stderr, stdout bytes.Buffer
 	cmd.Stderr = &stderr
 	cmd.Stdout = &stdout
 
 	if err := cmd.Run(); err != nil {
 		log.WithFields(log.Fields{
-			"event": "create thumbnail",
+			"event": event,
 			"error": err,
 		}).Error("could not run ", string(stdout.Bytes()), string(stderr.Bytes()))
-		return thumbnailName, err
+		return err
 	}
 	if errStr := string(stderr.Bytes()); errStr != "" {
 		log.WithFields(log.Fields{
-			"event": "create thumbnail",
+			"event": event,
 			"error": errStr,
 		}).Error("stdErr is not empty")
-		return thumbnailName, errors.New(errStr)
+		return errors.New(errStr)
 	}
-	return thumbnailName, nil
+	return nil
 }
 
-func HandleFile(r io.Reader, thumbnailSize int) (string, string, error) {
-	fileName, ct, err := SaveFile(r, viper.GetString("static_path")+filesFolder,
-		viper.GetInt64("max_image_size_mb")<<20)
-	if err != nil {
-		DeleteFile(getFilePath(fileName))
-		return "", "", err
+// thumbnailCommands are the commands that can create the thumbnail of the file,
+// they are tried in order until one of them succeeds
+func thumbnailCommands(contentType string, src string, dst string, size int) [][]string {
+	scale := fmt.Sprintf(`scale=w=%d:h=%d:force_original_aspect_ratio=decrease`, size, size)
+	switch {
+	case contentType == "image/avif":
+		return [][]string{{`ffmpeg`, `-i`, src, `-vframes`, `1`, `-vf`, scale, dst, `-loglevel`, `error`, `-y`}}
+	case strings.HasPrefix(contentType, "image"), contentType == "application/pdf":
+		// [0] takes the first frame. usefull for gifs and the first page of pdfs
+		return [][]string{{`gm`, `convert`,
+			`-size`, fmt.Sprintf(`%dx%d`, size, size), src + "[0]",
+			`-resize`, fmt.Sprintf(`%dx%d`, size, size), `+profile`, `"*"`, dst}}
+	case strings.HasPrefix(contentType, "audio"), contentType == "application/ogg":
+		// the cover art of the audio, or its waveform when it has no cover
+		return [][]string{
+			{`ffmpeg`, `-i`, src, `-an`, `-vframes`, `1`, `-vf`, scale, dst, `-loglevel`, `error`, `-y`},
+			{`ffmpeg`, `-i`, src, `-filter_complex`, fmt.Sprintf(`showwavespic=s=%dx%d`, size, size/2),
+				`-frames:v`, `1`, dst, `-loglevel`, `error`, `-y`}}
+	default:
+		return [][]string{{`ffmpeg`, `-i`, src, `-vframes`, `1`, `-vf`, scale, dst, `-loglevel`, `error`, `-y`}}
 	}
+}
+
+// thumbnailName is the name of the thumbnail of the file
+func thumbnailName(fileName string) string {
+	return strings.SplitAfter(fileName, ".")[0] + "webp"
+}
 
-	thumbnailName, err := CreateThumbnail(ct, fileName, thumbnailSize)
+func CreateThumbnail(ctx context.Context, contentType string, fileName string, size int) (string, error) {
+	thumbnail := thumbnailName(fileName)
+	var err error
+	for _, c := range thumbnailCommands(contentType, getUploadPath(fileName), getUploadThumbnailPath(thumbnail), size) {
+		if err = runCommand(ctx, "create thumbnail", c[0], c[1:]...); err == nil {
+			return thumbnail, nil
+		}
+	}
+	return thumbnail, err
+}
+
+// HandleFile saves the file and returns it with the name of its future thumbnail,
+// the thumbnail and the metadata are created later by a JobThumbnail job.
+// the extension of the file type must be one of the allowed extensions
+func HandleFile(r io.Reader, extensions []string) (FileInfo, error) {
+	var fi FileInfo
+	fileName, ct, size, err := SaveFile(r, viper.GetString("static_path")+uploadsFolder,
+		viper.GetInt64("max_image_size_mb")<<20, extensions)
 	if err != nil {
-		DeleteFileAndThumbnail(fileName, thumbnailName)
-		return "", "", err
+		DeleteFile(getUploadPath(fileName))
+		return fi, err
 	}
+	return FileInfo{Name: fileName, ThumbnailName: thumbnailName(fileName), ContentType: ct, Size: size}, nil
+}
 
-	return fileName, thumbnailName, nil
+// ShouldTranscode is true for large GIFs and MP4s when transcoding is enabled,
+// they are smaller and play everywhere as WebM
+func ShouldTranscode(fi FileInfo) bool {
+	return viper.GetBool("transcode") &&
+		(fi.ContentType == "image/gif" || fi.ContentType == "video/mp4") &&
+		fi.Size >= viper.GetInt64("transcode_min_size_mb")<<20
 }
 
-// we don't user this function because it take long time and consumes CPU
-// convert GIF to WebM
-func convertGIF(gifName string) (string, error) {
-	gifPath := getFilePath(gifName)
-	webmName := strings.SplitAfter(gifName, ".")[0] + "webm"
-	var cmd *exec.Cmd
+// TranscodeToWebM converts the file to WebM and returns the name and the size of the new file.
+// it takes long time and consumes CPU so it should run in the background,
+// the original file is kept and should be deleted by the caller
+func TranscodeToWebM(ctx context.Context, fileName string) (string, int64, error) {
+	webmName := strings.SplitAfter(fileName, ".")[0] + "webm"
 	// lower crf value => better quality
-	cmd = exec.Command(`ffmpeg`, `-i`, gifPath, `-c:v`, `libvpx-vp9`, `-crf`,
-		`30`, `-b:v`, `0`, getFilePath(webmName), `-loglevel`, `error`, `-y`)
-	defer DeleteFile(gifPath)
-	var stderr, stdout bytes.Buffer
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stdout
+	err := runCommand(ctx, "transcode", `ffmpeg`, `-i`, getUploadPath(fileName), `-c:v`, `libvpx-vp9`, `-crf`,
+		`30`, `-b:v`, `0`, getUploadPath(webmName), `-loglevel`, `error`, `-y`)
+	if err != nil {
+		DeleteFile(getUploadPath(webmName))
+		return "", 0, err
+	}
+	info, err := os.Stat(getUploadPath(webmName))
+	if err != nil {
+		return "", 0, err
+	}
+	return webmName, info.Size(), nil
+}
 
-	if err := cmd.Run(); err != nil {
-		log.WithFields(log.Fields{
-			"event": "convert GIF",
-			"error": err,
-		}).Error("could not run ", string(stdout.Bytes()), string(stderr.Bytes()))
-		return webmName, err
+// storeUpload copies the uploaded file of the path to the key of the storage
+func storeUpload(path string, key string, contentType string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	if errStr := string(stderr.Bytes()); errStr != "" {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return storage.Put(key, f, info.Size(), contentType)
+}
+
+func deleteStored(key string) {
+	if err := storage.Delete(key); err != nil {
 		log.WithFields(log.Fields{
-			"event": "convert GIF",
-			"error": errStr,
-		}).Error("stdErr is not empty")
-		return webmName, errors.New(errStr)
+			"event": "delete file",
+			"error": err,
+			"key":   key,
+		}).Error("could not delete file from storage")
 	}
-	return webmName, nil
 }
 
+// DeleteFileAndThumbnail deletes the file and the thumbnail from the storage
+// and their uploaded copies that weren't processed yet
 func DeleteFileAndThumbnail(file string, thumbnail string) {
-	DeleteFile(getFilePath(file))
-	DeleteFile(getThumbnailPath(thumbnail))
+	if file != "" {
+		deleteStored(filesFolder + file)
+		DeleteFile(getUploadPath(file))
+	}
+	if thumbnail != "" {
+		deleteStored(thumbnailsFolder + thumbnail)
+		DeleteFile(getUploadThumbnailPath(thumbnail))
+	}
 }
 
 // func HandleFile(r io.Reader, thumbnailSize int) (string, error) {
@@ -158,9 +292,10 @@ func DeleteFileAndThumbnail(file string, thumbnail string) {
 // 	return fileName, err
 // }
 
-func getFilePath(file string) string {
-	return viper.GetString("static_path") + filesFolder + file
+func getUploadPath(file string) string {
+	return viper.GetString("static_path") + uploadsFolder + file
 }
-func getThumbnailPath(thumbnail string) string {
-	return viper.GetString("static_path") + thumbnailsFolder + thumbnail
+
+func getUploadThumbnailPath(thumbnail string) string {
+	return viper.GetString("static_path") + uploadsFolder + thumbnailsFolder + thumbnail
 }
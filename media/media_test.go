@@ -0,0 +1,62 @@
+package media
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// the thumbnail of a WebP upload has the name of the upload, it must not overwrite the upload
+func TestWebPUploadKeepsOriginal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("static_path", dir+"/")
+	viper.Set("storage", "local")
+	defer viper.Set("static_path", nil)
+	defer viper.Set("storage", nil)
+	if err := InitStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "upload.webp"
+	thumbnail := thumbnailName(name)
+	src, dst := getUploadPath(name), getUploadThumbnailPath(thumbnail)
+	if src == dst {
+		t.Fatalf("the thumbnail is created at the path of the upload %s", src)
+	}
+	for _, c := range thumbnailCommands("image/webp", src, dst, thumbnailSize) {
+		if c[len(c)-1] != dst {
+			t.Errorf("thumbnail command %v doesn't write to %s", c, dst)
+		}
+	}
+
+	if err := ioutil.WriteFile(src, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// what gm writes for the thumbnail
+	if err := ioutil.WriteFile(dst, []byte("thumbnail"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeUpload(dst, thumbnailsFolder+thumbnail, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeUpload(src, filesFolder+name, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{filesFolder + name: "original", thumbnailsFolder + thumbnail: "thumbnail"} {
+		f, err := GetStorage().Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", key, b, want)
+		}
+	}
+}
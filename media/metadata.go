@@ -0,0 +1,84 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileInfo is the saved file with its thumbnail and metadata
+type FileInfo struct {
+	Name            string
+	ThumbnailName   string
+	ContentType     string
+	Size            int64
+	Width           int
+	Height          int
+	Duration        float64
+	ThumbnailWidth  int
+	ThumbnailHeight int
+}
+
+// probe returns the dimensions of the first video stream and the duration of the file,
+// images are a single frame video stream without a duration
+func probe(ctx context.Context, path string) (int, int, float64, error) {
+	cmd := exec.CommandContext(ctx, `ffprobe`, `-v`, `error`, `-select_streams`, `v:0`,
+		`-show_entries`, `stream=width,height:format=duration`, `-of`, `json`, path)
+	var stderr, stdout bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.WithFields(log.Fields{
+			"event": "probe file",
+			"error": err,
+		}).Error("could not run ", string(stderr.Bytes()))
+		return 0, 0, 0, err
+	}
+
+	var out struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return 0, 0, 0, err
+	}
+	var width, height int
+	if len(out.Streams) > 0 {
+		width, height = out.Streams[0].Width, out.Streams[0].Height
+	}
+	// still images report "N/A" or nothing as their duration
+	duration, _ := strconv.ParseFloat(out.Format.Duration, 64)
+	return width, height, duration, nil
+}
+
+// addMetadata fills the dimensions and the duration of the file and its thumbnail,
+// the file is kept without metadata if it can't be probed
+func addMetadata(ctx context.Context, fi *FileInfo, contentType string) {
+	visual := strings.HasPrefix(contentType, "image") || strings.HasPrefix(contentType, "video")
+	audio := strings.HasPrefix(contentType, "audio") || contentType == "application/ogg"
+	if visual || audio {
+		width, height, duration, err := probe(ctx, getUploadPath(fi.Name))
+		if err == nil {
+			if visual {
+				fi.Width, fi.Height = width, height
+			}
+			if !strings.HasPrefix(contentType, "image") {
+				fi.Duration = duration
+			}
+		}
+	}
+	width, height, _, err := probe(ctx, getUploadThumbnailPath(fi.ThumbnailName))
+	if err == nil {
+		fi.ThumbnailWidth, fi.ThumbnailHeight = width, height
+	}
+}
@@ -0,0 +1,239 @@
+package media
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// JobThumbnail creates the thumbnail and the metadata of an uploaded file
+	JobThumbnail = "thumbnail"
+	// JobTranscode converts large GIFs and MP4s to WebM
+	JobTranscode = "transcode"
+)
+
+// pollInterval is how often idle workers look for jobs that they weren't notified about,
+// like retries and jobs that were left when the server stopped
+const pollInterval = 10 * time.Second
+
+// Job is a persisted processing task of the file of a post
+type Job struct {
+	ID          int
+	PostID      int
+	Kind        string
+	FileName    string
+	ContentType string
+	// Attempts include the current attempt
+	Attempts int
+}
+
+// JobStore persists the jobs of the queue
+type JobStore interface {
+	// CreateMediaJob adds a pending job and returns its ID
+	CreateMediaJob(postID int, kind string, fileName string, contentType string) (int, error)
+	// ClaimMediaJob marks the oldest pending job as running, ok is false when no job is pending
+	ClaimMediaJob() (job Job, ok bool, err error)
+	// FinishMediaJob saves the processed file in the post and marks the job as done
+	FinishMediaJob(job Job, fi FileInfo) error
+	// RetryMediaJob returns the job to the pending jobs after the delay
+	RetryMediaJob(jobID int, errMsg string, delay time.Duration) error
+	// FailMediaJob marks the job as failed, the file of failed thumbnail jobs is removed from the post
+	FailMediaJob(job Job, errMsg string) error
+	// ResetMediaJobs returns the jobs that were running when the server stopped to the pending jobs
+	ResetMediaJobs() error
+}
+
+// Queue processes the jobs of the store with a bounded number of workers
+type Queue struct {
+	store   JobStore
+	workers int
+	timeout time.Duration
+	retries int
+	// onFinish is called with the post of the job when the job is done or failed
+	onFinish func(postID int)
+	wake     chan struct{}
+}
+
+// NewQueue creates a queue that is configured by media_workers, media_job_timeout_seconds
+// and media_job_retries
+func NewQueue(store JobStore, onFinish func(postID int)) *Queue {
+	workers := viper.GetInt("media_workers")
+	if workers < 1 {
+		workers = 1
+	}
+	timeout := time.Duration(viper.GetInt("media_job_timeout_seconds")) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	return &Queue{store: store, workers: workers, timeout: timeout,
+		retries:  viper.GetInt("media_job_retries"),
+		onFinish: onFinish,
+		wake:     make(chan struct{}, 1)}
+}
+
+// Start resumes the jobs of the previous run and starts the workers
+func (q *Queue) Start() {
+	if err := q.store.ResetMediaJobs(); err != nil {
+		log.WithFields(log.Fields{
+			"event": "reset media jobs",
+			"error": err,
+		}).Error("could not reset running media jobs")
+	}
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+}
+
+// Enqueue adds a job for the file of the post and returns its ID
+func (q *Queue) Enqueue(postID int, kind string, fi FileInfo) (int, error) {
+	jobID, err := q.store.CreateMediaJob(postID, kind, fi.Name, fi.ContentType)
+	if err != nil {
+		return 0, err
+	}
+	q.Notify()
+	return jobID, nil
+}
+
+// Notify wakes an idle worker if there is one, it is called after a job was created in the store
+func (q *Queue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		job, ok, err := q.store.ClaimMediaJob()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": "claim media job",
+				"error": err,
+			}).Error("could not claim media job")
+		}
+		if err != nil || !ok {
+			select {
+			case <-q.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+		// there may be more pending jobs for the other workers
+		q.Notify()
+		q.run(job)
+	}
+}
+
+func (q *Queue) run(job Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+
+	fi, err := process(ctx, job)
+	if err == nil {
+		if err = q.store.FinishMediaJob(job, fi); err == nil {
+			q.finished(job, fi)
+			return
+		}
+		discard(job, fi)
+	}
+	log.WithFields(log.Fields{
+		"event":    "process media job",
+		"error":    err,
+		"job_id":   job.ID,
+		"kind":     job.Kind,
+		"attempts": job.Attempts,
+	}).Error("could not process media job")
+
+	if job.Attempts <= q.retries {
+		err = q.store.RetryMediaJob(job.ID, err.Error(), time.Duration(job.Attempts)*pollInterval)
+	} else {
+		err = q.store.FailMediaJob(job, err.Error())
+		if err == nil && job.Kind == JobThumbnail {
+			DeleteFileAndThumbnail(job.FileName, thumbnailName(job.FileName))
+		} else if err == nil {
+			// the post keeps the stored original file
+			DeleteFile(getUploadPath(job.FileName))
+		}
+		q.onFinish(job.PostID)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":  "update media job",
+			"error":  err,
+			"job_id": job.ID,
+		}).Error("could not update media job")
+	}
+}
+
+// finished cleans up after the job and starts the jobs that follow it
+func (q *Queue) finished(job Job, fi FileInfo) {
+	switch job.Kind {
+	case JobThumbnail:
+		DeleteFile(getUploadThumbnailPath(fi.ThumbnailName))
+		// the transcode job needs the uploaded file
+		if !ShouldTranscode(fi) {
+			DeleteFile(getUploadPath(job.FileName))
+		} else {
+			if _, err := q.Enqueue(job.PostID, JobTranscode, fi); err != nil {
+				log.WithFields(log.Fields{
+					"event":   "create media job",
+					"error":   err,
+					"post_id": job.PostID,
+				}).Error("could not create transcode job")
+			}
+		}
+	case JobTranscode:
+		DeleteFile(getUploadPath(job.FileName))
+		deleteStored(filesFolder + job.FileName)
+	}
+	q.onFinish(job.PostID)
+}
+
+// discard deletes the stored files of a job that couldn't be saved in its post
+func discard(job Job, fi FileInfo) {
+	switch job.Kind {
+	case JobThumbnail:
+		deleteStored(filesFolder + fi.Name)
+		deleteStored(thumbnailsFolder + fi.ThumbnailName)
+	case JobTranscode:
+		deleteStored(filesFolder + fi.Name)
+	}
+}
+
+// process runs the job and stores the processed file
+func process(ctx context.Context, job Job) (FileInfo, error) {
+	fi := FileInfo{Name: job.FileName, ContentType: job.ContentType}
+	switch job.Kind {
+	case JobTranscode:
+		name, size, err := TranscodeToWebM(ctx, job.FileName)
+		if err != nil {
+			return fi, err
+		}
+		fi.Name, fi.ContentType, fi.Size = name, "video/webm", size
+		err = storeUpload(getUploadPath(name), filesFolder+name, fi.ContentType)
+		DeleteFile(getUploadPath(name))
+		return fi, err
+	default:
+		info, err := os.Stat(getUploadPath(job.FileName))
+		if err != nil {
+			return fi, err
+		}
+		fi.Size = info.Size()
+		fi.ThumbnailName, err = CreateThumbnail(ctx, job.ContentType, job.FileName, thumbnailSize)
+		if err != nil {
+			return fi, err
+		}
+		addMetadata(ctx, &fi, job.ContentType)
+		err = storeUpload(getUploadThumbnailPath(fi.ThumbnailName), thumbnailsFolder+fi.ThumbnailName, "image/webp")
+		if err != nil {
+			return fi, err
+		}
+		return fi, storeUpload(getUploadPath(fi.Name), filesFolder+fi.Name, fi.ContentType)
+	}
+}
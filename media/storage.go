@@ -0,0 +1,136 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Storage keeps the processed files and thumbnails, the keys are their paths
+// in the static folder like "files/name.webm" and "thumbnails/name.webp"
+type Storage interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get fails with os.ErrNotExist if there is no file with the key
+	Get(key string) (File, error)
+	// Delete doesn't fail if there is no file with the key
+	Delete(key string) error
+	// URL is the public address of the file, or an empty string if the file
+	// can't be accessed directly and should be proxied
+	URL(key string) string
+}
+
+// File is a stored file that can be read from any offset
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+	ModTime() time.Time
+}
+
+// storage is set by InitStorage when the server starts
+var storage Storage
+
+// InitStorage sets the storage of the files by the storage config, "local" or "s3",
+// and creates the uploads folder that keeps the files and their thumbnails until they are processed
+func InitStorage() error {
+	err := os.MkdirAll(filepath.Join(viper.GetString("static_path"), uploadsFolder, thumbnailsFolder), 0755)
+	if err != nil {
+		return err
+	}
+	switch viper.GetString("storage") {
+	case "", "local":
+		storage = LocalStorage{Root: viper.GetString("static_path")}
+	case "s3":
+		storage = &S3Storage{
+			Endpoint:  viper.GetString("s3_endpoint"),
+			Region:    viper.GetString("s3_region"),
+			Bucket:    viper.GetString("s3_bucket"),
+			AccessKey: viper.GetString("s3_access_key"),
+			SecretKey: viper.GetString("s3_secret_key"),
+			PathStyle: viper.GetBool("s3_path_style"),
+			PublicURL: viper.GetString("s3_public_url"),
+		}
+	default:
+		return errors.New("unknown storage " + viper.GetString("storage"))
+	}
+	return nil
+}
+
+// GetStorage returns the storage of the files
+func GetStorage() Storage {
+	return storage
+}
+
+// LocalStorage keeps the files in a folder of the server
+type LocalStorage struct {
+	Root string
+}
+
+func (s LocalStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (s LocalStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+type localFile struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f localFile) Size() int64 {
+	return f.info.Size()
+}
+
+func (f localFile) ModTime() time.Time {
+	return f.info.ModTime()
+}
+
+// Get doesn't open folders, they don't exist as keys
+func (s LocalStorage) Get(key string) (File, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return localFile{File: f, info: info}, nil
+}
+
+func (s LocalStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// URL is empty because the files are proxied by the server
+func (s LocalStorage) URL(key string) string {
+	return ""
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type namedExecer interface {
+	NamedExec(query string, arg interface{}) (sql.Result, error)
+}
+
+// insertAudit records an event in the audit log in the transaction or the database,
+// UserID, ActorID, TokenID and IP are optional
+func insertAudit(db namedExecer, ai AuditInsert) error {
+	_, err := db.NamedExec(`
+	INSERT INTO audit_log (event, user_id, actor_id, token_id, ip, created)
+	VALUES (:event, NULLIF(:user_id, 0), NULLIF(:actor_id, 0), NULLIF(:token_id, 0),
+		NULLIF(:ip, '')::inet, current_timestamp)`, ai)
+	return err
+}
+
+func (r *Repository) InsertAudit(ai AuditInsert) error {
+	return insertAudit(r.db, ai)
+}
+
+// GetAuditLog returns the events of the audit log from the newest
+func (r *Repository) GetAuditLog(page int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := r.db.Select(&entries, `
+	SELECT audit_log.id, audit_log.event, users.name AS "user", actors.name AS actor,
+	api_tokens.name AS token, host(audit_log.ip) AS ip, audit_log.created
+	FROM audit_log
+	LEFT JOIN users ON users.id = audit_log.user_id
+	LEFT JOIN users AS actors ON actors.id = audit_log.actor_id
+	LEFT JOIN api_tokens ON api_tokens.id = audit_log.token_id
+	ORDER BY audit_log.created DESC
+	LIMIT $1 OFFSET $1*($2-1)`, pageSize, page)
+	return entries, err
+}
+
+// UnlockUser unblocks the login of the user of the event and records the event
+func (r *Repository) UnlockUser(ai AuditInsert) error {
+	tx := r.db.MustBegin()
+	var name string
+	err := tx.Get(&name, `SELECT name FROM users WHERE id = $1`, ai.UserID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return errors.New("user not exists")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM login_attempts WHERE key_hash = $1`, loginKey("name", name))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = insertAudit(tx, ai); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
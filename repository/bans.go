@@ -1,6 +1,23 @@
 package repository
 
-import "errors"
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ErrIPExpired is returned when the poster of the post can't be banned
+// because its IP was removed after ip_retention_days
+var ErrIPExpired = errors.New("IP expired")
+
+// ipExpired is true if the post exists and its IP was removed
+func ipExpired(q sqlx.Queryer, postID int) bool {
+	var expired bool
+	err := sqlx.Get(q, &expired, `SELECT EXISTS(SELECT 1 FROM posts WHERE id=$1 AND ip IS NULL)`, postID)
+	return err == nil && expired
+}
 
 func (r *Repository) BanPoster(bpi BanPosterInsert) (string, error) {
 	var IP string
@@ -8,12 +25,16 @@ func (r *Repository) BanPoster(bpi BanPosterInsert) (string, error) {
 	rows, err := r.db.NamedQuery(`
 	INSERT INTO bans (ip, creator_id, reason, created)
 	SELECT ip, :creator_id, :reason, current_timestamp
-	FROM posts WHERE posts.id=:post_id
+	FROM posts WHERE posts.id=:post_id AND posts.ip IS NOT NULL
 	RETURNING ip`, bpi)
 	if err != nil {
 		return "", err
 	}
 	if !rows.Next() {
+		rows.Close()
+		if ipExpired(r.db, bpi.PostID) {
+			return "", ErrIPExpired
+		}
 		return "", errors.New("no IP found")
 	}
 	rows.Scan(&IP)
@@ -21,6 +42,46 @@ func (r *Repository) BanPoster(bpi BanPosterInsert) (string, error) {
 	return IP, err
 }
 
+var banScopes = map[string]string{
+	"post":   `posts.id=$2`,
+	"thread": `posts.thread_id=(SELECT thread_id FROM posts WHERE id=$2)`,
+	"board": `threads.board_id=(SELECT board_id FROM threads
+		INNER JOIN posts ON posts.thread_id=threads.id WHERE posts.id=$2)`,
+}
+
+// BanAndDeletePoster bans the IP of the post and marks the posts of the IP
+// in the scope ("post", "thread" or "board") of the post as deleted
+func (r *Repository) BanAndDeletePoster(bpi BanPosterInsert, scope string, boards pq.Int64Array) (string, []PostLocation, error) {
+	condition, ok := banScopes[scope]
+	if !ok {
+		return "", nil, errors.New("invalid scope")
+	}
+	tx := r.db.MustBegin()
+	var IP string
+	err := tx.Get(&IP, `
+	INSERT INTO bans (ip, creator_id, reason, created)
+	SELECT ip, $2, $3, current_timestamp
+	FROM posts
+	INNER JOIN threads ON threads.id=posts.thread_id
+	WHERE posts.id=$1 AND threads.board_id=ANY($4) AND posts.ip IS NOT NULL
+	RETURNING ip`, bpi.PostID, bpi.CreatorID, bpi.Reason, boards)
+	if err == sql.ErrNoRows && ipExpired(tx, bpi.PostID) {
+		err = ErrIPExpired
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+	l, err := markPostsDeleted(tx, `posts.ip=$1 AND threads.board_id=ANY($3) AND `+condition,
+		IP, bpi.PostID, boards)
+	if err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+	err = tx.Commit()
+	return IP, l, err
+}
+
 func (r *Repository) BanIP(bi BanInsert) error {
 	_, err := r.db.NamedExec(`
 	INSERT INTO bans (ip, creator_id, reason, created)
@@ -6,19 +6,31 @@ import (
 	"github.com/lib/pq"
 )
 
+// boardColumns are the columns of the Board of the boards table
+const boardColumns = `boards.id, uri, title, poster_ids, bump_limit, greentext, spoilers, code_blocks, math, nsfw, allowed_types, hide_file_names`
+
 func (r *Repository) GetBoards() ([]Board, error) {
 	var boards []Board
 	err := r.db.Select(&boards, `
-	SELECT id, uri, title
+	SELECT `+boardColumns+`
 	FROM boards
 	WHERE priority < 1000`)
 	return boards, err
 }
 
+func (r *Repository) GetBoard(uri string) (Board, error) {
+	var board Board
+	err := r.db.Get(&board, `
+	SELECT `+boardColumns+`
+	FROM boards
+	WHERE uri = $1`, uri)
+	return board, err
+}
+
 func (r *Repository) GetSpecificBoards(b pq.Int64Array) ([]Board, error) {
 	var boards []Board
 	err := r.db.Select(&boards, `
-	SELECT id, uri, title
+	SELECT `+boardColumns+`
 	FROM boards
 	WHERE id = ANY($1)`, b)
 	return boards, err
@@ -29,8 +41,8 @@ func (r *Repository) CreateBoard(bc BoardCreate) error {
 	var boardID int
 
 	rows, err := tx.NamedQuery(`
-	INSERT INTO boards (title, uri, priority)
-	VALUES (:title, :uri, :priority)
+	INSERT INTO boards (title, uri, priority, poster_ids, bump_limit, greentext, spoilers, code_blocks, math, nsfw, allowed_types, hide_file_names)
+	VALUES (:title, :uri, :priority, :poster_ids, :bump_limit, :greentext, :spoilers, :code_blocks, :math, :nsfw, :allowed_types, :hide_file_names)
 	RETURNING id`, bc)
 	if err != nil {
 		tx.Rollback()
@@ -42,6 +54,14 @@ func (r *Repository) CreateBoard(bc BoardCreate) error {
 	}
 	rows.Scan(&boardID)
 	rows.Close()
+	// posts can only be reported with a category so new boards get the default ones
+	_, err = tx.Exec(`
+	INSERT INTO report_categories (board_id, name, weight) VALUES
+	($1, 'Rule violation', 3), ($1, 'Spam', 2), ($1, 'Illegal content', 10)`, boardID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	_, err = tx.Exec(`
 	INSERT INTO users_boards (user_id, board_id, created)
 	SELECT id, $1, current_timestamp FROM users WHERE role='admin'`, boardID)
@@ -53,3 +73,19 @@ func (r *Repository) CreateBoard(bc BoardCreate) error {
 
 	return err
 }
+
+// UpdateBoardSettings if user has permission on the board, nil AllowedTypes keeps the file types of the board
+func (r *Repository) UpdateBoardSettings(boardURI string, bs BoardSettings, boards pq.Int64Array) error {
+	res, err := r.db.Exec(`
+	UPDATE boards SET poster_ids=$2, bump_limit=$3, greentext=$4, spoilers=$5, code_blocks=$6, math=$7, nsfw=$8,
+	allowed_types=COALESCE($9, allowed_types), hide_file_names=$10
+	WHERE uri=$1 AND id=ANY($11)`, boardURI, bs.PosterIDs, bs.BumpLimit,
+		bs.Greentext, bs.Spoilers, bs.Code, bs.Math, bs.NSFW, bs.AllowedTypes, bs.HideFileNames, boards)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("board not exists")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"sort"
+
+	"github.com/lib/pq"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+// loginKey is the key of the failed logins of an IP or of a name, they are saved by a hash
+// so the table doesn't keep IPs or the names, and passwords, that were typed in the name field
+func loginKey(kind string, value string) string {
+	return utils.HashIdentifier(kind + ":" + value)
+}
+
+// ReserveLogin counts a login attempt of the IP and the name as failed before the password is checked,
+// so concurrent attempts can't get past the backoff, it is undone by ResetLogin after a login.
+// it returns the seconds to wait while the logins of the IP or the name are blocked, the attempt isn't
+// counted then. names of unknown users are counted and locked like the names of users so they can't be told apart.
+// locked is true if the attempt locked the name
+func (r *Repository) ReserveLogin(IP string, name string, p LoginPolicy) (int, bool, error) {
+	nameKey := loginKey("name", name)
+	keys := pq.StringArray{loginKey("ip", IP), nameKey}
+	// the rows are locked in the same order by all the logins
+	sort.Strings(keys)
+	tx := r.db.MustBegin()
+	_, err := tx.Exec(`
+	INSERT INTO login_attempts (key_hash, failures, last_failure, blocked_until)
+	SELECT k, 0, current_timestamp, current_timestamp FROM unnest($1::text[]) AS k
+	ON CONFLICT (key_hash) DO NOTHING`, keys)
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	var attempts []struct {
+		KeyHash    string `json:"key_hash"`
+		Failures   int    `json:"failures"`
+		RetryAfter int    `json:"retry_after"`
+		Expired    bool   `json:"expired"`
+	}
+	err = tx.Select(&attempts, `
+	SELECT key_hash, failures,
+	GREATEST(CEIL(EXTRACT(EPOCH FROM blocked_until - current_timestamp)), 0)::int AS retry_after,
+	last_failure < current_timestamp - interval '1 hour' AS expired
+	FROM login_attempts
+	WHERE key_hash = ANY($1)
+	ORDER BY key_hash
+	FOR UPDATE`, keys)
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	retryAfter := 0
+	for _, a := range attempts {
+		if a.RetryAfter > retryAfter {
+			retryAfter = a.RetryAfter
+		}
+	}
+	if retryAfter > 0 {
+		tx.Rollback()
+		return retryAfter, false, nil
+	}
+
+	locked := false
+	for _, a := range attempts {
+		failures := a.Failures + 1
+		if a.Expired {
+			failures = 1
+		}
+		blocked := p.Delay(failures)
+		lock := a.KeyHash == nameKey && p.Locked(failures)
+		if lock {
+			blocked = p.LockoutMinutes * 60
+			locked = true
+		}
+		_, err = tx.Exec(`
+		UPDATE login_attempts SET failures = $2, last_failure = current_timestamp,
+		blocked_until = current_timestamp + $3 * interval '1 second', locked = $4
+		WHERE key_hash = $1`, a.KeyHash, failures, blocked, lock)
+		if err != nil {
+			tx.Rollback()
+			return 0, false, err
+		}
+	}
+	return 0, locked, tx.Commit()
+}
+
+// ResetLogin starts the count of failed logins of the name over after a login,
+// and takes back the attempt that ReserveLogin counted for the IP
+func (r *Repository) ResetLogin(IP string, name string) error {
+	_, err := r.db.Exec(`DELETE FROM login_attempts WHERE key_hash = $1`, loginKey("name", name))
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`
+	UPDATE login_attempts SET failures = GREATEST(failures - 1, 0), blocked_until = current_timestamp
+	WHERE key_hash = $1`, loginKey("ip", IP))
+	return err
+}
+
+// DeleteOldLoginAttempts deletes the failed logins that no longer count
+func (r *Repository) DeleteOldLoginAttempts() error {
+	_, err := r.db.Exec(`
+	DELETE FROM login_attempts
+	WHERE last_failure < current_timestamp - interval '1 hour' AND blocked_until < current_timestamp`)
+	return err
+}
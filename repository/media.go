@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/noamdb/modernboard/media"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// CreateMediaJob creates a pending job for the file of the post and returns its ID
+func (r *Repository) CreateMediaJob(postID int, kind string, fileName string, contentType string) (int, error) {
+	return createMediaJob(r.db, postID, kind, fileName, contentType)
+}
+
+// createMediaJob creates the job with q, the thumbnail job of a new post is created
+// in the transaction of the post so a post is never left processing without a job
+func createMediaJob(q sqlx.Queryer, postID int, kind string, fileName string, contentType string) (int, error) {
+	var jobID int
+	err := sqlx.Get(q, &jobID, `
+	INSERT INTO media_jobs (post_id, kind, status, file_name, content_type, run_after, created, updated)
+	VALUES ($1, $2, $3, $4, $5, current_timestamp, current_timestamp, current_timestamp)
+	RETURNING id`, postID, kind, JobPending, fileName, contentType)
+	return jobID, err
+}
+
+func (r *Repository) GetMediaJob(jobID int) (MediaJob, error) {
+	var job MediaJob
+	err := r.db.Get(&job, `
+	SELECT id, post_id, kind, status, attempts, error, created, updated
+	FROM media_jobs
+	WHERE id = $1`, jobID)
+	return job, err
+}
+
+// ClaimMediaJob marks the oldest pending job as running. SKIP LOCKED lets
+// workers of several servers claim jobs concurrently
+func (r *Repository) ClaimMediaJob() (media.Job, bool, error) {
+	var job media.Job
+	err := r.db.QueryRowx(`
+	UPDATE media_jobs SET status=$1, attempts=attempts+1, updated=current_timestamp
+	WHERE id = (
+		SELECT id FROM media_jobs
+		WHERE status=$2 AND run_after <= current_timestamp
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED)
+	RETURNING id, post_id, kind, file_name, content_type, attempts`, JobRunning, JobPending).
+		Scan(&job.ID, &job.PostID, &job.Kind, &job.FileName, &job.ContentType, &job.Attempts)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	}
+	return job, err == nil, err
+}
+
+// FinishMediaJob saves the processed file in the post and marks the job as done.
+// the post is updated only if its file is still the file of the job
+func (r *Repository) FinishMediaJob(job media.Job, fi media.FileInfo) error {
+	tx := r.db.MustBegin()
+	var res sql.Result
+	var err error
+	switch job.Kind {
+	case media.JobTranscode:
+		res, err = tx.Exec(`
+		UPDATE posts SET file_name=$3, file_size=$4
+		WHERE id=$1 AND file_name=$2`, job.PostID, job.FileName, fi.Name, fi.Size)
+	default:
+		res, err = tx.Exec(`
+		UPDATE posts SET thumbnail_name=$3, file_size=$4, file_width=$5, file_height=$6, file_duration=$7,
+			thumbnail_width=$8, thumbnail_height=$9, file_processing=false
+		WHERE id=$1 AND file_name=$2`, job.PostID, job.FileName, fi.ThumbnailName, fi.Size,
+			fi.Width, fi.Height, fi.Duration, fi.ThumbnailWidth, fi.ThumbnailHeight)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return errors.New("the file of the post was removed")
+	}
+	_, err = tx.Exec(`
+	UPDATE media_jobs SET status=$2, error='', updated=current_timestamp
+	WHERE id=$1`, job.ID, JobDone)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RetryMediaJob returns the job to the pending jobs after the delay
+func (r *Repository) RetryMediaJob(jobID int, errMsg string, delay time.Duration) error {
+	_, err := r.db.Exec(`
+	UPDATE media_jobs SET status=$2, error=$3, updated=current_timestamp,
+		run_after=current_timestamp + $4 * interval '1 second'
+	WHERE id=$1`, jobID, JobPending, errMsg, int(delay.Seconds()))
+	return err
+}
+
+// FailMediaJob marks the job as failed, the file of failed thumbnail jobs is removed from
+// the post because it can't be shown
+func (r *Repository) FailMediaJob(job media.Job, errMsg string) error {
+	tx := r.db.MustBegin()
+	_, err := tx.Exec(`
+	UPDATE media_jobs SET status=$2, error=$3, updated=current_timestamp
+	WHERE id=$1`, job.ID, JobFailed, errMsg)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if job.Kind == media.JobThumbnail {
+		_, err = tx.Exec(`
+		UPDATE posts SET file_name='', thumbnail_name='', file_original_name='', file_spoiler=false,
+			file_size=0, file_width=0, file_height=0, file_duration=0, thumbnail_width=0, thumbnail_height=0,
+			file_processing=false
+		WHERE id=$1 AND file_name=$2`, job.PostID, job.FileName)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ResetMediaJobs returns the running jobs to the pending jobs, they were stopped with the server
+func (r *Repository) ResetMediaJobs() error {
+	_, err := r.db.Exec(`
+	UPDATE media_jobs SET status=$1, updated=current_timestamp
+	WHERE status=$2`, JobPending, JobRunning)
+	return err
+}
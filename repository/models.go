@@ -23,26 +23,59 @@ func (ns *NullString) MarshalJSON() ([]byte, error) {
 }
 
 type ThreadInsert struct {
-	BoardURI string `json:"board_uri"`
-	Subject  string `json:"subject"`
-	IsSticky bool   `json:"is_sticky"`
-	IsLocked bool   `json:"is_locked"`
+	BoardURI string      `json:"board_uri"`
+	Subject  string      `json:"subject"`
+	IsSticky bool        `json:"is_sticky"`
+	IsLocked bool        `json:"is_locked"`
+	Poll     *PollInsert `json:"poll"`
+	// PosterIDEpoch is set when the thread is created
+	PosterIDEpoch int64 `json:"poster_id_epoch"`
+}
+
+type PollInsert struct {
+	Question string     `json:"question"`
+	Multiple bool       `json:"multiple"`
+	Closes   *time.Time `json:"closes"`
+	Options  []string   `json:"options"`
+}
+
+func (pi PollInsert) Valid() bool {
+	if !utils.ValidLength(pi.Question, 1, 200) ||
+		len(pi.Options) < 2 || len(pi.Options) > 10 {
+		return false
+	}
+	for _, o := range pi.Options {
+		if !utils.ValidLength(o, 1, 100) {
+			return false
+		}
+	}
+	return pi.Closes == nil || pi.Closes.After(time.Now())
 }
 
 type ThreadWithOP struct {
-	ID            int       `json:"id"`
-	PostID        int       `json:"post_id"`
-	Subject       string    `json:"subject"`
-	IsLocked      bool      `json:"is_locked"`
-	IsSticky      bool      `json:"is_sticky"`
-	Author        string    `json:"author"`
-	Tripcode      string    `json:"tripcode"`
-	BodyHTML      string    `json:"body_html"`
-	ThumbnailName string    `json:"thumbnail_name"`
-	FileName      string    `json:"file_name"`
-	Created       time.Time `json:"created"`
-	PostsCount    string    `json:"posts_count"`
-	ImagesCount   string    `json:"images_count"`
+	ID            int    `json:"id"`
+	PostID        int    `json:"post_id"`
+	Subject       string `json:"subject"`
+	IsLocked      bool   `json:"is_locked"`
+	IsSticky      bool   `json:"is_sticky"`
+	IsAutosage    bool   `json:"is_autosage"`
+	IsCyclical    bool   `json:"is_cyclical"`
+	MovedTo       int    `json:"moved_to,omitempty"`
+	Author        string `json:"author"`
+	Tripcode      string `json:"tripcode"`
+	Capcode       string `json:"capcode"`
+	BodyHTML      string `json:"body_html"`
+	ThumbnailName string `json:"thumbnail_name"`
+	FileName      string `json:"file_name"`
+	FileSpoiler   bool   `json:"file_spoiler"`
+	FileMetadata
+	Created       time.Time      `json:"created"`
+	PostsCount    string         `json:"posts_count"`
+	ImagesCount   string         `json:"images_count"`
+	PosterID      string         `json:"poster_id,omitempty"`
+	PosterIDCount int            `json:"poster_id_count,omitempty"`
+	IsEdited      bool           `json:"is_edited"`
+	Poll          types.JSONText `json:"poll"`
 }
 
 type ThreadManageWithOP struct {
@@ -52,45 +85,155 @@ type ThreadManageWithOP struct {
 }
 
 type ThreadWithPosts struct {
-	Subject  string         `json:"subject"`
-	IsLocked bool           `json:"is_locked"`
-	IsSticky bool           `json:"is_sticky"`
-	Tripcode string         `json:"tripcode"`
-	Posts    types.JSONText `json:"posts"`
+	Subject    string         `json:"subject"`
+	IsLocked   bool           `json:"is_locked"`
+	IsSticky   bool           `json:"is_sticky"`
+	IsAutosage bool           `json:"is_autosage"`
+	IsCyclical bool           `json:"is_cyclical"`
+	MovedTo    int            `json:"moved_to,omitempty"`
+	Tripcode   string         `json:"tripcode"`
+	Poll       types.JSONText `json:"poll"`
+	Posts      types.JSONText `json:"posts"`
+}
+
+type ThreadMove struct {
+	ThreadID int    `json:"thread_id"`
+	BoardURI string `json:"board_uri"`
+	// StubBody is the body of the redirect stub left in the old board,
+	// no stub is created when it is empty
+	StubBody     string `json:"stub_body"`
+	StubBodyHTML string `json:"stub_body_html"`
+}
+
+type ThreadMerge struct {
+	ThreadID int `json:"thread_id"`
+	TargetID int `json:"target_id"`
+	// StubBody is the body of the post that is left in the merged thread
+	StubBody     string `json:"stub_body"`
+	StubBodyHTML string `json:"stub_body_html"`
 }
 
 type PostSelect struct {
-	ID               int           `json:"id"`
-	Author           string        `json:"author"`
-	Tripcode         string        `json:"tripcode"`
-	BodyHTML         string        `json:"body_html"`
-	ThumbnailName    string        `json:"thumbnail_name"`
-	FileName         string        `json:"file_name"`
-	FileOriginalName string        `json:"file_original_name"`
-	Created          time.Time     `json:"created"`
-	Replies          pq.Int64Array `json:"replies"`
+	ID               int    `json:"id"`
+	Author           string `json:"author"`
+	Tripcode         string `json:"tripcode"`
+	Capcode          string `json:"capcode"`
+	BodyHTML         string `json:"body_html"`
+	ThumbnailName    string `json:"thumbnail_name"`
+	FileName         string `json:"file_name"`
+	FileOriginalName string `json:"file_original_name"`
+	FileSpoiler      bool   `json:"file_spoiler"`
+	FileMetadata
+	Created       time.Time     `json:"created"`
+	Replies       pq.Int64Array `json:"replies"`
+	PosterID      string        `json:"poster_id,omitempty"`
+	PosterIDCount int           `json:"poster_id_count,omitempty"`
+	IsEdited      bool          `json:"is_edited"`
+}
+
+// FileMetadata are the size and the dimensions of the file of the post and its thumbnail
+type FileMetadata struct {
+	FileSize        int64   `json:"file_size"`
+	FileWidth       int     `json:"file_width"`
+	FileHeight      int     `json:"file_height"`
+	FileDuration    float64 `json:"file_duration"`
+	ThumbnailWidth  int     `json:"thumbnail_width"`
+	ThumbnailHeight int     `json:"thumbnail_height"`
+	// FileProcessing is true until the thumbnail and the metadata of the file are created
+	FileProcessing bool `json:"file_processing"`
 }
 
 type PostInsert struct {
-	ThreadID         int           `json:"thread_id"`
-	Author           string        `json:"author"`
-	Tripcode         string        `json:"tripcode"`
-	Body             string        `json:"body"`
-	BodyHTML         string        `json:"body_html"`
-	FileName         string        `json:"file_name"`
-	FileOriginalName string        `json:"file_original_name"`
-	ThumbnailName    string        `json:"thumbnail_name"`
-	IP               string        `json:"ip"`
-	AuthorID         string        `json:"author_id"`
-	Bump             bool          `json:"bump"`
-	Created          time.Time     `json:"created"`
-	Replies          pq.Int64Array `json:"replies"`
+	ThreadID         int    `json:"thread_id"`
+	Author           string `json:"author"`
+	Tripcode         string `json:"tripcode"`
+	Capcode          string `json:"capcode"`
+	Body             string `json:"body"`
+	BodyHTML         string `json:"body_html"`
+	FileName         string `json:"file_name"`
+	FileOriginalName string `json:"file_original_name"`
+	ThumbnailName    string `json:"thumbnail_name"`
+	FileSpoiler      bool   `json:"file_spoiler"`
+	// FileContentType is the type of the uploaded file for its thumbnail job
+	FileContentType string `json:"-"`
+	FileMetadata
+	IP       string `json:"ip"`
+	AuthorID string `json:"author_id"`
+	PosterID string `json:"poster_id"`
+	// Bump is false when the poster saged, the thread bump limit and autosage
+	// are checked when the post is inserted
+	Bump    bool          `json:"bump"`
+	Created time.Time     `json:"created"`
+	Replies pq.Int64Array `json:"replies"`
 }
 
 type UserLoginGet struct {
-	ID       int    `json:"id"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	ID               int    `json:"id"`
+	Password         string `json:"password"`
+	Role             string `json:"role"`
+	TwoFactorEnabled bool   `json:"totp_enabled"`
+	// TwoFactorRequired is true if the role of the user requires 2FA
+	TwoFactorRequired bool `json:"require_2fa"`
+}
+
+// LoginPolicy is the backoff and lockout of failed logins
+type LoginPolicy struct {
+	// FreeAttempts are the failures before the login is delayed
+	FreeAttempts int
+	// MaxDelay is the longest delay in seconds, the delay doubles after each failure
+	MaxDelay int
+	// LockoutAttempts are the failures after which the account is locked for LockoutMinutes
+	LockoutAttempts int
+	LockoutMinutes  int
+}
+
+// Delay is the number of seconds the login is blocked after the failures
+func (p LoginPolicy) Delay(failures int) int {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := 1
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// Locked is true if the account is locked after the failures
+func (p LoginPolicy) Locked(failures int) bool {
+	return p.LockoutAttempts > 0 && failures >= p.LockoutAttempts
+}
+
+// Audit events
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditTwoFactorReset  = "2fa_reset"
+	AuditTokenCreated    = "token_created"
+	AuditTokenDeleted    = "token_deleted"
+	AuditTokenUsed       = "token_used"
+)
+
+type AuditInsert struct {
+	Event   string `json:"event"`
+	UserID  int    `json:"user_id"`
+	ActorID int    `json:"actor_id"`
+	TokenID int    `json:"token_id"`
+	IP      string `json:"ip"`
+}
+
+type AuditEntry struct {
+	ID    int        `json:"id"`
+	Event string     `json:"event"`
+	User  NullString `json:"user"`
+	Actor NullString `json:"actor"`
+	Token NullString `json:"token"`
+	IP    NullString `json:"ip"`
+	// Created is when the event happened
+	Created time.Time `json:"created"`
 }
 
 type UserCreate struct {
@@ -99,10 +242,11 @@ type UserCreate struct {
 	Role     string `json:"role"`
 }
 
+// Valid doesn't check that the role exists, the user can't be created with a role that doesn't exist
 func (uc UserCreate) Valid() bool {
 	return utils.ValidLength(uc.Name, 1, 20) &&
 		utils.ValidLength(uc.Password, 4, 30) &&
-		utils.PermissionExists(uc.Role)
+		utils.ValidLength(uc.Role, 1, 20)
 }
 
 type UserSelect struct {
@@ -110,34 +254,193 @@ type UserSelect struct {
 	Name    string    `json:"name"`
 	Role    string    `json:"role"`
 	Created time.Time `json:"created"`
+	// Locked is true while the name of the user is locked after failed logins
+	Locked bool `json:"locked"`
 }
 
 type BoardUser struct {
 	UserSelect
+	BoardOverrides
+}
+
+// BoardOverrides are the capabilities that are granted to the user and revoked
+// from the user on a board, in addition to the capabilities of the role
+type BoardOverrides struct {
+	Granted pq.StringArray `json:"granted"`
+	Revoked pq.StringArray `json:"revoked"`
+}
+
+// Valid is false if a global capability is granted, they can't be granted on a board
+func (bo BoardOverrides) Valid() bool {
+	for _, c := range bo.Granted {
+		if utils.IsGlobalCapability(c) {
+			return false
+		}
+	}
+	return utils.ValidCapabilities(bo.Granted) && utils.ValidCapabilities(bo.Revoked)
+}
+
+// Role is a bundle of capabilities
+type Role struct {
+	Name         string         `json:"name"`
+	Capabilities pq.StringArray `json:"capabilities"`
+	// AllBoards roles have their capabilities on all the boards,
+	// other roles only on the boards of the user
+	AllBoards  bool      `json:"all_boards"`
+	Require2FA bool      `json:"require_2fa"`
+	Created    time.Time `json:"created"`
+}
+
+func (r Role) Valid() bool {
+	return utils.ValidLength(r.Name, 1, 20) && utils.ValidCapabilities(r.Capabilities)
+}
+
+// BoardSettings are the board options that can be changed by the admins
+type BoardSettings struct {
+	// PosterIDs shows a per thread ID of the poster on every post
+	PosterIDs bool `json:"poster_ids"`
+	// BumpLimit is the number of replies after which the thread stops bumping
+	BumpLimit int `json:"bump_limit"`
+	utils.Markup
+	// NSFW boards have adult content
+	NSFW bool `json:"nsfw"`
+	// AllowedTypes are the extensions of the file types that can be uploaded
+	AllowedTypes pq.StringArray `json:"allowed_types"`
+	// HideFileNames hides the original names of the uploaded files from the posters
+	HideFileNames bool `json:"hide_file_names"`
+}
+
+// DefaultBumpLimit is the bump limit of boards that were created without one
+const DefaultBumpLimit = 300
+
+func (bs BoardSettings) Valid() bool {
+	return bs.BumpLimit > 0 && bs.BumpLimit <= 10000
 }
 
 type Board struct {
 	ID    int    `json:"id"`
 	Title string `json:"title"`
 	Uri   string `json:"uri"`
+	BoardSettings
+}
+
+// ThreadBoard is the board of a thread with the options of the thread that posting depends on
+type ThreadBoard struct {
+	Board
+	IsCyclical bool `json:"is_cyclical"`
 }
 
 type BoardCreate struct {
 	Title    string `json:"title"`
 	Uri      string `json:"uri"`
 	Priority int    `json:"priority"`
+	BoardSettings
 }
 
 func (bc BoardCreate) Valid() bool {
 	return utils.ValidLength(bc.Title, 1, 15) &&
-		utils.ValidLength(bc.Uri, 1, 10)
+		utils.ValidLength(bc.Uri, 1, 10) && bc.BoardSettings.Valid()
 }
 
 type User struct {
-	ID       int           `json:"id"`
-	Password string        `json:"password"`
-	Role     string        `json:"role"`
-	Boards   pq.Int64Array `json:"boards"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	// SessionID is the session the user was authenticated with
+	SessionID int `json:"-"`
+	// TokenID is the API token the user was authenticated with
+	TokenID           int  `json:"-"`
+	TwoFactorEnabled  bool `json:"two_factor_enabled"`
+	TwoFactorRequired bool `json:"two_factor_required"`
+	// Capabilities are the capabilities of the role of the user
+	Capabilities pq.StringArray `json:"capabilities"`
+	// Boards are the boards where the user has the capability that the request requires
+	Boards pq.Int64Array `json:"boards"`
+	// BoardCapabilities are the effective capabilities of the user on each of the boards of the user
+	BoardCapabilities []BoardCapabilities `json:"board_capabilities"`
+}
+
+// NeedsTwoFactor is true if the role requires 2FA and the user didn't enable it,
+// the user can only manage its own account
+func (u User) NeedsTwoFactor() bool {
+	return u.TwoFactorRequired && !u.TwoFactorEnabled
+}
+
+// BoardCapabilitiesOf returns the capabilities of the user on the board
+func (u User) BoardCapabilitiesOf(boardURI string) []string {
+	for _, b := range u.BoardCapabilities {
+		if b.BoardURI == boardURI {
+			return b.Capabilities
+		}
+	}
+	return nil
+}
+
+// BoardsWith returns the boards where the user has the capability
+func (u User) BoardsWith(capability string) pq.Int64Array {
+	boards := pq.Int64Array{}
+	for _, b := range u.BoardCapabilities {
+		if utils.HasCapability(b.Capabilities, capability) {
+			boards = append(boards, b.BoardID)
+		}
+	}
+	return boards
+}
+
+type APITokenInsert struct {
+	UserID       int            `json:"user_id"`
+	Name         string         `json:"name"`
+	TokenHash    string         `json:"token_hash"`
+	Capabilities pq.StringArray `json:"capabilities"`
+	Boards       pq.Int64Array  `json:"boards"`
+	Expires      *time.Time     `json:"expires"`
+}
+
+type APIToken struct {
+	ID           int            `json:"id"`
+	Name         string         `json:"name"`
+	Capabilities pq.StringArray `json:"capabilities"`
+	// Boards are the URIs of the boards of the token, all the boards of the user if it's empty
+	Boards   pq.StringArray `json:"boards"`
+	Expires  *time.Time     `json:"expires"`
+	LastUsed *time.Time     `json:"last_used"`
+	Created  time.Time      `json:"created"`
+}
+
+type SessionInsert struct {
+	Token     string `json:"token"`
+	UserID    int    `json:"user_id"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	// Expires is the expiry of the session even if it's used
+	Expires          time.Time `json:"expires"`
+	TwoFactorPending bool      `json:"two_factor_pending"`
+}
+
+// TwoFactorLogin is a session that waits for the 2FA code of the user
+type TwoFactorLogin struct {
+	SessionID  int    `json:"session_id"`
+	UserID     int    `json:"user_id"`
+	Role       string `json:"role"`
+	TOTPSecret string `json:"totp_secret"`
+}
+
+type Session struct {
+	ID        int        `json:"id"`
+	UserAgent string     `json:"user_agent"`
+	IP        NullString `json:"ip"`
+	Created   time.Time  `json:"created"`
+	LastSeen  time.Time  `json:"last_seen"`
+	Expires   time.Time  `json:"expires"`
+	// Current is true for the session of the request
+	Current bool `json:"current"`
+}
+
+type BoardCapabilities struct {
+	BoardID      int64    `json:"board_id"`
+	BoardURI     string   `json:"board_uri"`
+	Capabilities []string `json:"capabilities"`
 }
 
 type TrendingThread struct {
@@ -148,28 +451,51 @@ type TrendingThread struct {
 }
 
 type ReportInsert struct {
-	Reason   string    `json:"reason"`
-	PostID   int       `json:"post_id"`
-	IP       string    `json:"ip"`
-	AuthorID string    `json:"author_id"`
-	Created  time.Time `json:"created"`
+	Reason     string    `json:"reason"`
+	PostID     int       `json:"post_id"`
+	CategoryID int       `json:"category_id"`
+	IP         string    `json:"ip"`
+	AuthorID   string    `json:"author_id"`
+	Reporter   string    `json:"reporter_hash"`
+	Created    time.Time `json:"created"`
+}
+
+type ReportCategory struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+type ReportCategoryCreate struct {
+	BoardURI string `json:"board_uri"`
+	Name     string `json:"name"`
+	Weight   int    `json:"weight"`
+}
+
+func (rcc ReportCategoryCreate) Valid() bool {
+	return utils.ValidLength(rcc.Name, 1, 30) &&
+		rcc.Weight >= 1 && rcc.Weight <= 10
 }
 
 type ReportedPost struct {
-	ID               int            `json:"id"`
-	ThreadID         int            `json:"thread_id"`
-	BoardURI         string         `json:"board_uri"`
-	Subject          NullString     `json:"subject"`
-	Author           string         `json:"author"`
-	AuthorID         string         `json:"author_id"`
-	Tripcode         string         `json:"tripcode"`
-	BodyHTML         string         `json:"body_html"`
-	ThumbnailName    string         `json:"thumbnail_name"`
-	FileName         string         `json:"file_name"`
-	FileOriginalName string         `json:"file_original_name"`
-	Created          time.Time      `json:"created"`
-	IsOP             bool           `json:"is_op"`
-	Reports          types.JSONText `json:"reports"`
+	ID               int        `json:"id"`
+	ThreadID         int        `json:"thread_id"`
+	BoardURI         string     `json:"board_uri"`
+	Subject          NullString `json:"subject"`
+	Author           string     `json:"author"`
+	AuthorID         string     `json:"author_id"`
+	Tripcode         string     `json:"tripcode"`
+	Capcode          string     `json:"capcode"`
+	BodyHTML         string     `json:"body_html"`
+	ThumbnailName    string     `json:"thumbnail_name"`
+	FileName         string     `json:"file_name"`
+	FileOriginalName string     `json:"file_original_name"`
+	FileSpoiler      bool       `json:"file_spoiler"`
+	FileMetadata
+	Created time.Time      `json:"created"`
+	IsOP    bool           `json:"is_op"`
+	Score   float64        `json:"score"`
+	Reports types.JSONText `json:"reports"`
 }
 
 type BanInsert struct {
@@ -192,3 +518,61 @@ type PostFiles struct {
 	ThumbnailName string `json:"thumbnail_name"`
 	FileName      string `json:"file_name"`
 }
+
+// PostEdit is the new body of an edited post and the posts it quotes
+type PostEdit struct {
+	PostID   int           `json:"post_id"`
+	EditorID int           `json:"editor_id"`
+	Body     string        `json:"body"`
+	BodyHTML string        `json:"body_html"`
+	Replies  pq.Int64Array `json:"replies"`
+}
+
+// PosterPost is a post in the history of a poster, IP is null on the boards where
+// the user can't view IPs and after the IP was removed
+type PosterPost struct {
+	ID               int    `json:"id"`
+	ThreadID         int    `json:"thread_id"`
+	BoardURI         string `json:"board_uri"`
+	Author           string `json:"author"`
+	AuthorID         string `json:"author_id"`
+	Tripcode         string `json:"tripcode"`
+	Capcode          string `json:"capcode"`
+	BodyHTML         string `json:"body_html"`
+	ThumbnailName    string `json:"thumbnail_name"`
+	FileName         string `json:"file_name"`
+	FileOriginalName string `json:"file_original_name"`
+	FileSpoiler      bool   `json:"file_spoiler"`
+	FileMetadata
+	IP      NullString `json:"ip"`
+	Deleted bool       `json:"deleted"`
+	Created time.Time  `json:"created"`
+}
+
+type PostRevision struct {
+	ID           int              `json:"id"`
+	Editor       NullString       `json:"editor"`
+	PreviousBody string           `json:"previous_body"`
+	Body         string           `json:"body"`
+	Created      time.Time        `json:"created"`
+	Diff         []utils.DiffLine `json:"diff"`
+}
+
+// MediaJob is a background job on the file of a post
+type MediaJob struct {
+	ID       int       `json:"id"`
+	PostID   int       `json:"post_id"`
+	Kind     string    `json:"kind"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// PostLocation is the thread and board of a post, used to invalidate caches
+type PostLocation struct {
+	ID       int    `json:"id"`
+	ThreadID int    `json:"thread_id"`
+	BoardURI string `json:"board_uri"`
+}
@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrPollClosed   = errors.New("poll is closed")
+	ErrAlreadyVoted = errors.New("already voted")
+)
+
+// pollJSON selects the poll of the thread "t" with the votes count of every option
+const pollJSON = `
+	COALESCE((SELECT row_to_json(pl) FROM (
+		SELECT polls.id, question, multiple, closes,
+		is_closed OR COALESCE(closes <= current_timestamp, false) AS is_closed,
+		(SELECT COUNT(voter) FROM poll_voters WHERE poll_id = polls.id) AS voters,
+		(SELECT json_agg(row_to_json(o)) FROM (
+			SELECT poll_options.id, text,
+			(SELECT COUNT(voter) FROM poll_votes WHERE option_id = poll_options.id) AS votes
+			FROM poll_options
+			WHERE poll_id = polls.id
+			ORDER BY position ASC) AS o) AS options
+		FROM polls
+		WHERE thread_id = t.id) AS pl), 'null')`
+
+func createPoll(tx *sqlx.Tx, threadID int, p PollInsert) error {
+	var pollID int
+	err := tx.Get(&pollID, `
+	INSERT INTO polls (thread_id, question, multiple, closes)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id`, threadID, p.Question, p.Multiple, p.Closes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO poll_options (poll_id, text, position)
+	SELECT $1, o.text, o.position
+	FROM unnest($2::text[]) WITH ORDINALITY AS o(text, position)`,
+		pollID, pq.StringArray(p.Options))
+	return err
+}
+
+// Vote adds the votes of the voter to the poll of the thread,
+// single choice polls accept exactly one option
+func (r *Repository) Vote(threadID int, voter string, options pq.Int64Array) error {
+	tx := r.db.MustBegin()
+	var poll struct {
+		ID       int  `json:"id"`
+		Multiple bool `json:"multiple"`
+	}
+	err := tx.Get(&poll, `
+	SELECT id, multiple FROM polls
+	WHERE thread_id=$1 AND is_closed=false AND (closes IS NULL OR closes > current_timestamp)
+	FOR UPDATE`, threadID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrPollClosed
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !poll.Multiple && len(options) != 1 {
+		tx.Rollback()
+		return errors.New("single choice poll")
+	}
+
+	res, err := tx.Exec(`
+	INSERT INTO poll_voters (poll_id, voter, created)
+	VALUES ($1, $2, current_timestamp)
+	ON CONFLICT DO NOTHING`, poll.ID, voter)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrAlreadyVoted
+	}
+	res, err = tx.Exec(`
+	INSERT INTO poll_votes (option_id, voter)
+	SELECT id, $2 FROM poll_options
+	WHERE poll_id=$1 AND id=ANY($3)`, poll.ID, voter, options)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); int(n) != len(options) {
+		tx.Rollback()
+		return errors.New("option not exists")
+	}
+	err = tx.Commit()
+	return err
+}
+
+// ClosePoll if user has permission on the board
+func (r *Repository) ClosePoll(threadID int, boards pq.Int64Array) error {
+	_, err := r.db.Exec(`
+	UPDATE polls SET is_closed=true
+	FROM threads
+	WHERE threads.id=polls.thread_id AND polls.thread_id=$1 AND board_id=ANY($2)`,
+		threadID, boards)
+	return err
+}
+
+// ResetPoll removes all the votes of the poll if user has permission on the board
+func (r *Repository) ResetPoll(threadID int, boards pq.Int64Array) error {
+	tx := r.db.MustBegin()
+	var pollID int
+	err := tx.Get(&pollID, `
+	SELECT polls.id FROM polls
+	INNER JOIN threads ON threads.id=polls.thread_id
+	WHERE polls.thread_id=$1 AND board_id=ANY($2)
+	FOR UPDATE OF polls`, threadID, boards)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+	DELETE FROM poll_votes
+	USING poll_options
+	WHERE poll_options.id=option_id AND poll_id=$1`, pollID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM poll_voters WHERE poll_id=$1`, pollID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
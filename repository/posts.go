@@ -3,116 +3,530 @@ package repository
 import (
 	"errors"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/utils"
 )
 
-func (r *Repository) CreatePost(pi PostInsert) error {
+// SpoilerThumbnail is shown instead of the thumbnail of spoilered files,
+// it is served from the thumbnails folder
+const SpoilerThumbnail = "spoiler.webp"
+
+// spoilerThumbnailSize is the width and the height of the spoiler thumbnail that install.sh creates
+const spoilerThumbnailSize = "250"
+
+// ProcessingThumbnail is shown until the media job of the file creates its thumbnail,
+// it is served from the thumbnails folder
+const ProcessingThumbnail = "processing.webp"
+
+// publicThumbnail selects the thumbnail of the post that is shown to posters
+const publicThumbnail = `CASE WHEN file_processing THEN '` + ProcessingThumbnail + `'
+	WHEN file_spoiler THEN '` + SpoilerThumbnail + `' ELSE thumbnail_name END AS thumbnail_name`
+
+// fileMetadata are the columns of the FileMetadata of the post
+const fileMetadata = `file_size, file_width, file_height, file_duration, thumbnail_width, thumbnail_height, file_processing`
+
+// publicFileMetadata are the columns of the FileMetadata of the post that is shown to posters,
+// the thumbnail size of spoilered files is the size of the spoiler thumbnail
+const publicFileMetadata = `file_size, file_width, file_height, file_duration,
+	CASE WHEN file_spoiler AND NOT file_processing THEN ` + spoilerThumbnailSize + ` ELSE thumbnail_width END AS thumbnail_width,
+	CASE WHEN file_spoiler AND NOT file_processing THEN ` + spoilerThumbnailSize + ` ELSE thumbnail_height END AS thumbnail_height,
+	file_processing`
+
+// CreatePost returns the ID of the new post and the ID of the thumbnail job of its file, or 0 if it has no file.
+// the post doesn't bump the thread if the poster saged, the thread is autosaged or the thread reached the bump limit of the board
+func (r *Repository) CreatePost(pi PostInsert) (int, int, error) {
 	tx := r.db.MustBegin()
 	var postID int
+	var epoch int64
+	err := tx.Get(&epoch, `SELECT poster_id_epoch FROM threads WHERE id = $1`, pi.ThreadID)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
 	pi.AuthorID = utils.EncryptString(pi.IP)
-	rows, err := r.db.NamedQuery(`
-	INSERT INTO posts (thread_id, author, body, body_html, tripcode, ip, author_id, bump, created, file_name, file_original_name, thumbnail_name)
-	VALUES (:thread_id, :author, :body, :body_html, :tripcode, :ip, :author_id, :bump, current_timestamp, :file_name, :file_original_name, :thumbnail_name)
+	pi.PosterID = utils.PosterID(pi.IP, pi.ThreadID, epoch)
+	rows, err := tx.NamedQuery(`
+	INSERT INTO posts (thread_id, author, body, body_html, tripcode, capcode, ip, author_id, poster_id, bump, created, file_name, file_original_name, thumbnail_name, file_spoiler,
+		`+fileMetadata+`)
+	SELECT t.id, :author, :body, :body_html, :tripcode, :capcode, :ip, :author_id, :poster_id,
+	:bump AND NOT t.is_autosage AND
+		(SELECT COUNT(id) FROM posts WHERE posts.thread_id = t.id) <= b.bump_limit,
+	current_timestamp, :file_name, :file_original_name, :thumbnail_name, :file_spoiler,
+	:file_size, :file_width, :file_height, :file_duration, :thumbnail_width, :thumbnail_height, :file_processing
+	FROM threads AS t
+	INNER JOIN boards AS b ON b.id = t.board_id
+	WHERE t.id = :thread_id
 	RETURNING id`, pi)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return 0, 0, err
 	}
 	if !rows.Next() {
+		rows.Close()
 		tx.Rollback()
-		return errors.New("board not exists")
+		return 0, 0, errors.New("board not exists")
 	}
 	rows.Scan(&postID)
 	rows.Close()
 
-	if len(pi.Replies) > 0 {
-		_, err = tx.Exec(`
-		INSERT INTO replies (post_id, reply_id)
-		SELECT id, $1 FROM posts WHERE id = ANY($2) AND thread_id = $3`, postID, pi.Replies, pi.ThreadID)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	if err = insertReplies(tx, postID, pi.Replies); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	jobID, err := createThumbnailJob(tx, postID, pi)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
 	}
 
 	err = tx.Commit()
+	return postID, jobID, err
+}
+
+// createThumbnailJob creates the job that processes the uploaded file of the new post,
+// it returns 0 if the post has no file
+func createThumbnailJob(tx *sqlx.Tx, postID int, pi PostInsert) (int, error) {
+	if pi.FileName == "" {
+		return 0, nil
+	}
+	return createMediaJob(tx, postID, media.JobThumbnail, pi.FileName, pi.FileContentType)
+}
+
+// insertReplies records the post as a reply of the quoted posts, the quotes were resolved
+// by ResolveQuotes so the quoted posts can be in other threads and in other boards
+func insertReplies(tx *sqlx.Tx, postID int, replies pq.Int64Array) error {
+	if len(replies) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+	INSERT INTO replies (post_id, reply_id)
+	SELECT posts.id, $1 FROM posts
+	WHERE posts.id = ANY($2) AND posts.id <> $1`, postID, replies)
 	return err
 }
 
-func (r *Repository) ReportPost(report ReportInsert) error {
+// ResolveQuotes returns the location of the quoted posts that exist,
+// quotes without a board URI are looked up in the given board
+func (r *Repository) ResolveQuotes(boardURI string, quotes []utils.Quote) (map[utils.Quote]utils.QuoteTarget, error) {
+	resolved := make(map[utils.Quote]utils.QuoteTarget)
+	if len(quotes) == 0 {
+		return resolved, nil
+	}
+	uris := make(pq.StringArray, len(quotes))
+	ids := make(pq.Int64Array, len(quotes))
+	for i, q := range quotes {
+		uris[i] = q.BoardURI
+		if uris[i] == "" {
+			uris[i] = boardURI
+		}
+		ids[i] = q.PostID
+	}
+	var targets []utils.QuoteTarget
+	err := r.db.Select(&targets, `
+	SELECT posts.id AS post_id, threads.id AS thread_id, boards.uri AS board_uri
+	FROM unnest($1::text[], $2::int[]) AS q(uri, post_id)
+	INNER JOIN posts ON posts.id = q.post_id
+	INNER JOIN threads ON threads.id = posts.thread_id
+	INNER JOIN boards ON boards.id = threads.board_id AND boards.uri = q.uri
+	WHERE posts.deleted IS NOT true AND threads.deleted IS NOT true`, uris, ids)
+	if err != nil {
+		return resolved, err
+	}
+	found := make(map[utils.Quote]utils.QuoteTarget)
+	for _, t := range targets {
+		found[utils.Quote{BoardURI: t.BoardURI, PostID: t.PostID}] = t
+	}
+	for i, q := range quotes {
+		if t, ok := found[utils.Quote{BoardURI: uris[i], PostID: q.PostID}]; ok {
+			resolved[q] = t
+		}
+	}
+	return resolved, nil
+}
+
+// ToggleFileSpoiler adds or removes the spoiler of the file of the post if user has permission on board
+func (r *Repository) ToggleFileSpoiler(postID int, boards pq.Int64Array) (PostLocation, error) {
+	var l PostLocation
+	err := r.db.Get(&l, `
+	UPDATE posts SET file_spoiler = NOT file_spoiler
+	FROM threads, boards
+	WHERE threads.id=posts.thread_id AND boards.id=threads.board_id
+	AND posts.id=$1 AND threads.board_id=ANY($2) AND posts.file_name <> ''
+	RETURNING posts.id, posts.thread_id, boards.uri AS board_uri`, postID, boards)
+	return l, err
+}
+
+// GetPostLocation returns the thread and the board of the post
+func (r *Repository) GetPostLocation(postID int) (PostLocation, error) {
+	var l PostLocation
+	err := r.db.Get(&l, `
+	SELECT posts.id, posts.thread_id, boards.uri AS board_uri
+	FROM posts
+	INNER JOIN threads ON threads.id = posts.thread_id
+	INNER JOIN boards ON boards.id = threads.board_id
+	WHERE posts.id = $1`, postID)
+	return l, err
+}
+
+// GetFileOriginalName returns the name that the file had when it was uploaded,
+// or an empty string if the board hides the names of the files
+func (r *Repository) GetFileOriginalName(fileName string) (string, error) {
+	var name string
+	err := r.db.Get(&name, `
+	SELECT CASE WHEN boards.hide_file_names THEN '' ELSE file_original_name END
+	FROM posts
+	INNER JOIN threads ON threads.id = posts.thread_id
+	INNER JOIN boards ON boards.id = threads.board_id
+	WHERE posts.file_name = $1
+	LIMIT 1`, fileName)
+	return name, err
+}
+
+// ReportPost if the category belongs to the board of the post and the IP
+// sent less than limit reports in the last given minutes
+func (r *Repository) ReportPost(report ReportInsert, limit int, minutes int) error {
 	report.AuthorID = utils.EncryptString(report.IP)
-	_, err := r.db.NamedExec(`
-	INSERT INTO reports (reason, post_id, ip, author_id, created, dismissed)
-	VALUES (:reason, :post_id, :ip, :author_id, current_timestamp, false)`, report)
-	return err
+	report.Reporter = utils.HashIdentifier("reporter:" + report.IP)
+	tx := r.db.MustBegin()
+	// the reports of the IP are counted under a lock so concurrent reports can't pass the limit
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, report.Reporter)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var count int
+	err = tx.Get(&count, `
+	SELECT COUNT(id) FROM reports
+	WHERE reporter_hash=$1 AND created > current_timestamp - $2 * interval '1 minute'`, report.Reporter, minutes)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count >= limit {
+		tx.Rollback()
+		return ErrTooManyReports
+	}
+	res, err := tx.NamedExec(`
+	INSERT INTO reports (reason, post_id, category_id, ip, reporter_hash, author_id, created, dismissed)
+	SELECT :reason, posts.id, c.id, :ip, :reporter_hash, :author_id, current_timestamp, false
+	FROM posts
+	INNER JOIN threads ON threads.id=posts.thread_id
+	INNER JOIN report_categories AS c ON c.board_id=threads.board_id
+	WHERE posts.id=:post_id AND c.id=:category_id`, report)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return errors.New("report category not exists")
+	}
+	return tx.Commit()
 }
 
 func (r *Repository) GetPostsAfter(postID int) ([]PostSelect, error) {
 	var posts []PostSelect
 	err := r.db.Select(&posts, `
-	SELECT id, author, body_html, tripcode, file_name, thumbnail_name, file_original_name, 
-	posts.created, (SELECT array_agg(r.reply_id) FROM (SELECT reply_id FROM replies WHERE post_id = id) AS r) AS replies
-	FROM posts,
+	SELECT posts.id, author, body_html, tripcode, capcode, is_edited, file_name, file_spoiler, `+publicFileMetadata+`,
+	CASE WHEN boards.hide_file_names THEN '' ELSE file_original_name END AS file_original_name,
+	`+publicThumbnail+`,
+	posts.created, (SELECT array_agg(r.reply_id) FROM (SELECT reply_id FROM replies WHERE post_id = posts.id) AS r) AS replies,
+	CASE WHEN boards.poster_ids THEN poster_id ELSE '' END AS poster_id,
+	CASE WHEN boards.poster_ids THEN (SELECT COUNT(id) FROM posts AS pos
+		WHERE pos.thread_id = posts.thread_id AND pos.poster_id = posts.poster_id AND pos.deleted IS NOT true)
+	ELSE 0 END AS poster_id_count
+	FROM posts
+	INNER JOIN threads ON threads.id = posts.thread_id
+	INNER JOIN boards ON boards.id = threads.board_id,
 		LATERAL (SELECT thread_id, created
 		FROM posts 
 		WHERE id = $1
 		ORDER BY created ASC LIMIT 1) AS after_post
 	WHERE posts.thread_id=after_post.thread_id AND (posts.created > after_post.created) AND posts.deleted IS NOT true
-	ORDER BY created ASC`, postID)
+	ORDER BY posts.created ASC`, postID)
 	return posts, err
 }
 
 // DismissReport if user has permission on the board
 func (r *Repository) DismissReport(reportID int, boards pq.Int64Array) error {
 	_, err := r.db.Exec(`
-			UPDATE reports SET dismissed=true
-			WHERE reports.id=$1
-			AND EXISTS(SELECT posts.id FROM posts
-            	INNER JOIN threads ON threads.id=posts.thread_id 
-           		WHERE posts.id=post_id 
-		   		AND board_id=ANY($2))`, reportID, boards)
+	WITH dismissed AS (
+		UPDATE reports SET dismissed=true
+		WHERE reports.id=$1 AND dismissed=false AND actioned=false
+		AND EXISTS(SELECT posts.id FROM posts
+			INNER JOIN threads ON threads.id=posts.thread_id
+			WHERE posts.id=post_id
+			AND board_id=ANY($2))
+		RETURNING reporter_hash)
+	INSERT INTO reporters (reporter_hash, dismissed)
+	SELECT reporter_hash, 1 FROM dismissed
+	ON CONFLICT (reporter_hash) DO UPDATE SET dismissed = reporters.dismissed + 1`, reportID, boards)
 	return err
 
 }
 
 // GetReportedPosts returns the reported posts for the given boards,
-// if post is an OP it will return the thread data as well
+// if post is an OP it will return the thread data as well.
+// posts are ordered by their score - the sum of the category weights of their reports,
+// each weighted by the reliability of the reporter
 func (r *Repository) GetReportedPosts(boards pq.Int64Array, page int) ([]ReportedPost, error) {
 	var posts []ReportedPost
 	err := r.db.Select(&posts, `
-	SELECT p.id, author, body_html, tripcode, author_id, file_name, thumbnail_name, 
-	file_original_name, created, thread_id, boards.uri AS board_uri, is_op, reports,
+	SELECT p.id, author, body_html, tripcode, capcode, author_id, file_name, thumbnail_name, 
+	file_original_name, file_spoiler, `+fileMetadata+`, created, thread_id, boards.uri AS board_uri, is_op, reports, score,
 	CASE WHEN is_op = true
 	THEN subject
 	END AS subject
 		FROM(
-		SELECT posts.id, posts.thread_id, op.thread_id IS NOT NULL AS is_op, author, body_html, tripcode, author_id, file_name, thumbnail_name, file_original_name, created,
-		(SELECT json_agg(row_to_json(r)) FROM (SELECT id, reason, author_id, created FROM reports WHERE post_id=posts.id AND dismissed=false ORDER BY created DESC) AS r) AS reports
+		SELECT posts.id, posts.thread_id, op.thread_id IS NOT NULL AS is_op, author, body_html, tripcode, capcode, author_id, file_name, thumbnail_name, file_original_name, file_spoiler, `+fileMetadata+`, created,
+		(SELECT json_agg(row_to_json(r)) FROM (
+			SELECT reports.id, reason, c.name AS category, c.weight, author_id, created,
+			(COALESCE(rep.actioned, 0) + 1)::float / (COALESCE(rep.actioned, 0) + COALESCE(rep.dismissed, 0) + 2) AS reliability
+			FROM reports
+			LEFT JOIN report_categories AS c ON c.id=category_id
+			LEFT JOIN reporters AS rep ON rep.reporter_hash=reports.reporter_hash
+			WHERE post_id=posts.id AND dismissed=false AND actioned=false
+			ORDER BY created DESC) AS r) AS reports
 		FROM posts
 		LEFT JOIN (SELECT DISTINCT ON(thread_id) id, thread_id FROM posts as posts2
 				WHERE id=posts2.id
-				ORDER BY thread_id, created ASC) AS op ON posts.id = op.id
+				ORDER BY thread_id, is_op DESC, created ASC) AS op ON posts.id = op.id
 		WHERE deleted IS NOT true) p
+	CROSS JOIN LATERAL
+		(SELECT COALESCE(SUM((r->>'weight')::float * (r->>'reliability')::float), 0) AS score
+		FROM json_array_elements(p.reports) AS r) AS s
 	LEFT JOIN threads ON threads.id=p.thread_id AND threads.deleted IS NOT true
 	LEFT JOIN boards ON boards.id=threads.board_id
  	WHERE board_id=ANY($1) AND reports IS NOT NULL
-	ORDER BY (reports->0->>'created')::timestamp DESC
+	ORDER BY score DESC, json_array_length(reports) DESC, (reports->0->>'created')::timestamp DESC
 		LIMIT $2 OFFSET $2*($3-1)`, boards, pageSize, page)
 	return posts, err
 }
 
 // MarkPostDeleted if user has permission on board
 func (r *Repository) MarkPostDeleted(PostID int, boards pq.Int64Array) error {
-	_, err := r.db.Exec(`
-			UPDATE posts SET deleted=true
+	tx := r.db.MustBegin()
+	var deleted pq.Int64Array
+	err := tx.Get(&deleted, `
+			WITH p AS (UPDATE posts SET deleted=true
 			FROM threads
-			WHERE threads.id=posts.thread_id AND board_id=ANY($2) AND posts.id=$1`,
+			WHERE threads.id=posts.thread_id AND board_id=ANY($2) AND posts.id=$1
+			RETURNING posts.id)
+			SELECT array_agg(id) FROM p`,
 		PostID, boards)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = actionReports(tx, deleted); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
 	return err
 
 }
 
+// EditPost replaces the body of the post and its replies and keeps the previous body
+// as a revision, if user has permission on board
+func (r *Repository) EditPost(pe PostEdit, boards pq.Int64Array) (PostLocation, error) {
+	tx := r.db.MustBegin()
+	var l PostLocation
+	var previousBody string
+	err := tx.QueryRowx(`
+	SELECT posts.id, posts.thread_id, boards.uri, COALESCE(posts.body, '')
+	FROM posts
+	INNER JOIN threads ON threads.id=posts.thread_id
+	INNER JOIN boards ON boards.id=threads.board_id
+	WHERE posts.id=$1 AND threads.board_id=ANY($2)
+	FOR UPDATE OF posts`, pe.PostID, boards).Scan(&l.ID, &l.ThreadID, &l.BoardURI, &previousBody)
+	if err != nil {
+		tx.Rollback()
+		return l, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO post_revisions (post_id, editor_id, previous_body, body, created)
+	VALUES ($1, $2, $3, $4, current_timestamp)`, pe.PostID, pe.EditorID, previousBody, pe.Body)
+	if err != nil {
+		tx.Rollback()
+		return l, err
+	}
+	_, err = tx.Exec(`
+	UPDATE posts SET body=$2, body_html=$3, is_edited=true
+	WHERE id=$1`, pe.PostID, pe.Body, pe.BodyHTML)
+	if err != nil {
+		tx.Rollback()
+		return l, err
+	}
+	_, err = tx.Exec(`DELETE FROM replies WHERE reply_id=$1`, pe.PostID)
+	if err != nil {
+		tx.Rollback()
+		return l, err
+	}
+	if err = insertReplies(tx, pe.PostID, pe.Replies); err != nil {
+		tx.Rollback()
+		return l, err
+	}
+	err = tx.Commit()
+	return l, err
+}
+
+// GetPostRevisions returns the edits of the post from the newest, if user has permission on board
+func (r *Repository) GetPostRevisions(postID int, boards pq.Int64Array) ([]PostRevision, error) {
+	var revisions []PostRevision
+	err := r.db.Select(&revisions, `
+	SELECT post_revisions.id, users.name AS editor, previous_body, post_revisions.body, post_revisions.created
+	FROM post_revisions
+	INNER JOIN posts ON posts.id=post_revisions.post_id
+	INNER JOIN threads ON threads.id=posts.thread_id
+	LEFT JOIN users ON users.id=post_revisions.editor_id
+	WHERE post_revisions.post_id=$1 AND threads.board_id=ANY($2)
+	ORDER BY post_revisions.created DESC`, postID, boards)
+	for i := range revisions {
+		revisions[i].Diff = utils.LineDiff(revisions[i].PreviousBody, revisions[i].Body)
+	}
+	return revisions, err
+}
+
+// GetPosterHistory returns the posts with the IP or author ID of the post from the newest,
+// in the boards of the user. IPs are returned only for the posts in ipBoards
+func (r *Repository) GetPosterHistory(postID int, boards pq.Int64Array, ipBoards pq.Int64Array, page int) ([]PosterPost, error) {
+	var posts []PosterPost
+	err := r.db.Select(&posts, `
+	SELECT posts.id, posts.thread_id, boards.uri AS board_uri, posts.author, posts.author_id,
+	COALESCE(posts.tripcode, '') AS tripcode, posts.capcode, COALESCE(posts.body_html, '') AS body_html,
+	COALESCE(posts.thumbnail_name, '') AS thumbnail_name, COALESCE(posts.file_name, '') AS file_name,
+	COALESCE(posts.file_original_name, '') AS file_original_name, posts.file_spoiler, `+fileMetadata+`,
+	CASE WHEN threads.board_id=ANY($3) THEN host(posts.ip) END AS ip,
+	posts.deleted IS true AS deleted, posts.created
+	FROM posts
+	INNER JOIN threads ON threads.id=posts.thread_id
+	INNER JOIN boards ON boards.id=threads.board_id
+	INNER JOIN (SELECT p.ip, p.author_id FROM posts AS p
+		INNER JOIN threads AS t ON t.id=p.thread_id
+		WHERE p.id=$1 AND t.board_id=ANY($2)) AS poster
+		ON posts.ip=poster.ip OR posts.author_id=poster.author_id
+	WHERE threads.board_id=ANY($2)
+	ORDER BY posts.created DESC
+	LIMIT $4 OFFSET $4*($5-1)`, postID, boards, ipBoards, pageSize, page)
+	return posts, err
+}
+
+// ClearOldIPs removes the IPs of the posts, reports, sessions and audit events older than the given days,
+// the posts can still be linked by their author ID and the reporters by their hash
+func (r *Repository) ClearOldIPs(days int) error {
+	tx := r.db.MustBegin()
+	_, err := tx.Exec(`
+	UPDATE posts SET ip=NULL
+	WHERE ip IS NOT NULL AND created < current_date - $1 * interval '1 day'`, days)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE reports SET ip=NULL
+	WHERE ip IS NOT NULL AND created < current_date - $1 * interval '1 day'`, days)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE sessions SET ip=NULL
+	WHERE ip IS NOT NULL AND created < current_date - $1 * interval '1 day'`, days)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE audit_log SET ip=NULL
+	WHERE ip IS NOT NULL AND created < current_date - $1 * interval '1 day'`, days)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// markPostsDeleted marks the posts matching the condition as deleted and actions their reports.
+// the condition may refer to the posts, threads and boards tables
+func markPostsDeleted(tx *sqlx.Tx, condition string, args ...interface{}) ([]PostLocation, error) {
+	var l []PostLocation
+	err := tx.Select(&l, `
+	UPDATE posts SET deleted=true
+	FROM threads, boards
+	WHERE threads.id=posts.thread_id AND boards.id=threads.board_id
+	AND posts.deleted IS NOT true AND `+condition+`
+	RETURNING posts.id, posts.thread_id, boards.uri AS board_uri`, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(pq.Int64Array, len(l))
+	for i, p := range l {
+		ids[i] = int64(p.ID)
+	}
+	err = actionReports(tx, ids)
+	return l, err
+}
+
+// MarkPostsDeleted marks the posts on the user boards as deleted
+func (r *Repository) MarkPostsDeleted(postIDs pq.Int64Array, boards pq.Int64Array) ([]PostLocation, error) {
+	tx := r.db.MustBegin()
+	l, err := markPostsDeleted(tx, `posts.id=ANY($1) AND threads.board_id=ANY($2)`,
+		postIDs, boards)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	return l, err
+}
+
+// MarkAuthorThreadPostsDeleted marks all the posts of the author in the thread as deleted
+func (r *Repository) MarkAuthorThreadPostsDeleted(authorID string, threadID int, boards pq.Int64Array) ([]PostLocation, error) {
+	tx := r.db.MustBegin()
+	l, err := markPostsDeleted(tx, `posts.author_id=$1 AND threads.id=$2 AND threads.board_id=ANY($3)`,
+		authorID, threadID, boards)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	return l, err
+}
+
+// MarkAuthorBoardPostsDeleted marks all the posts of the author in the board as deleted
+func (r *Repository) MarkAuthorBoardPostsDeleted(authorID string, boardURI string, boards pq.Int64Array) ([]PostLocation, error) {
+	tx := r.db.MustBegin()
+	l, err := markPostsDeleted(tx, `posts.author_id=$1 AND boards.uri=$2 AND threads.board_id=ANY($3)`,
+		authorID, boardURI, boards)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	return l, err
+}
+
+// DeletePostFile removes the file of the post but keeps the text,
+// returns the removed files so they can be deleted from the disk
+func (r *Repository) DeletePostFile(postID int, boards pq.Int64Array) (PostFiles, PostLocation, error) {
+	var f PostFiles
+	var l PostLocation
+	err := r.db.QueryRowx(`
+	UPDATE posts SET file_name='', thumbnail_name='', file_original_name='', file_spoiler=false,
+		file_size=0, file_width=0, file_height=0, file_duration=0, thumbnail_width=0, thumbnail_height=0,
+		file_processing=false
+	FROM threads, boards,
+		(SELECT id, file_name, thumbnail_name FROM posts WHERE id=$1 FOR UPDATE) AS old
+	WHERE old.id=posts.id AND threads.id=posts.thread_id AND boards.id=threads.board_id
+	AND threads.board_id=ANY($2) AND posts.file_name <> ''
+	RETURNING old.file_name, old.thumbnail_name, posts.id, posts.thread_id, boards.uri`,
+		postID, boards).Scan(&f.FileName, &f.ThumbnailName, &l.ID, &l.ThreadID, &l.BoardURI)
+	return f, l, err
+}
+
 // DeletePosts delete posts that are marked as deleted and return their files
 func (r *Repository) DeletePosts(days int) ([]PostFiles, error) {
 	tx := r.db.MustBegin()
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ErrTooManyReports is returned when the IP sent the maximum number of reports
+var ErrTooManyReports = errors.New("too many reports")
+
+func (r *Repository) GetReportCategories(boardURI string) ([]ReportCategory, error) {
+	var c []ReportCategory
+	err := r.db.Select(&c, `
+	SELECT report_categories.id, name, weight FROM report_categories
+	INNER JOIN boards ON boards.id=board_id
+	WHERE boards.uri=$1
+	ORDER BY weight DESC, name ASC`, boardURI)
+	return c, err
+}
+
+// CreateReportCategory if user has permission on the board
+func (r *Repository) CreateReportCategory(rcc ReportCategoryCreate, boards pq.Int64Array) error {
+	res, err := r.db.Exec(`
+	INSERT INTO report_categories (board_id, name, weight)
+	SELECT id, $2, $3 FROM boards
+	WHERE uri=$1 AND id=ANY($4)`, rcc.BoardURI, rcc.Name, rcc.Weight, boards)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("board not exists")
+	}
+	return nil
+}
+
+// DeleteReportCategory if user has permission on the board,
+// reports of the category are kept without a category
+func (r *Repository) DeleteReportCategory(categoryID int, boards pq.Int64Array) error {
+	_, err := r.db.Exec(`
+	DELETE FROM report_categories
+	WHERE id=$1 AND board_id=ANY($2)`, categoryID, boards)
+	return err
+}
+
+// actionReports marks the open reports of the posts as actioned
+// and credits their reporters
+func actionReports(tx *sqlx.Tx, postIDs pq.Int64Array) error {
+	_, err := tx.Exec(`
+	WITH actioned AS (
+		UPDATE reports SET actioned=true
+		WHERE post_id=ANY($1) AND dismissed=false AND actioned=false
+		RETURNING reporter_hash)
+	INSERT INTO reporters (reporter_hash, actioned)
+	SELECT reporter_hash, COUNT(reporter_hash) FROM actioned GROUP BY reporter_hash
+	ON CONFLICT (reporter_hash) DO UPDATE SET actioned = reporters.actioned + EXCLUDED.actioned`,
+		postIDs)
+	return err
+}
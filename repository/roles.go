@@ -0,0 +1,42 @@
+package repository
+
+import "errors"
+
+// AdminRole can't be deleted and its capabilities can't be changed so there is always
+// a role that can manage the users
+const AdminRole = "admin"
+
+func (r *Repository) GetRoles() ([]Role, error) {
+	var roles []Role
+	err := r.db.Select(&roles, `
+	SELECT name, capabilities, all_boards, require_2fa, created FROM roles
+	ORDER BY created`)
+	return roles, err
+}
+
+// SaveRole creates the role or updates its capabilities,
+// only the 2FA requirement of the admin role can be changed
+func (r *Repository) SaveRole(role Role) error {
+	if role.Name == AdminRole {
+		_, err := r.db.Exec(`UPDATE roles SET require_2fa=$2 WHERE name=$1`, role.Name, role.Require2FA)
+		return err
+	}
+	_, err := r.db.NamedExec(`
+	INSERT INTO roles (name, capabilities, all_boards, require_2fa, created)
+	VALUES (:name, :capabilities, :all_boards, :require_2fa, current_timestamp)
+	ON CONFLICT (name) DO UPDATE SET capabilities=EXCLUDED.capabilities, all_boards=EXCLUDED.all_boards,
+	require_2fa=EXCLUDED.require_2fa`, role)
+	return err
+}
+
+// DeleteRole fails if the role has users
+func (r *Repository) DeleteRole(name string) error {
+	res, err := r.db.Exec(`DELETE FROM roles WHERE name=$1 AND name<>$2`, name, AdminRole)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("role not exists")
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package repository
 
 import (
 	"errors"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"gitlab.com/noamdb/modernboard/utils"
 )
@@ -11,14 +13,18 @@ import (
 func (r *Repository) GetThreads(boardURI string, page int) ([]ThreadWithOP, error) {
 	var threads []ThreadWithOP
 	err := r.db.Select(&threads, `
-	SELECT t.id, t.subject, t.is_sticky, t.is_locked, p.id AS post_id, p.author, p.body_html, p.tripcode, p.file_name, p.thumbnail_name, 
-	p.created, posts.count - 1 as posts_count, images.count - 1 as images_count
+	SELECT t.id, t.subject, t.is_sticky, t.is_locked, t.is_autosage, t.is_cyclical, COALESCE(t.moved_to, 0) AS moved_to, p.id AS post_id, p.author, p.body_html, p.tripcode, p.capcode, p.is_edited, p.file_name, p.thumbnail_name, p.file_spoiler, 
+	p.file_size, p.file_width, p.file_height, p.file_duration, p.thumbnail_width, p.thumbnail_height,
+	p.created, posts.count - 1 as posts_count, images.count - 1 as images_count,
+	CASE WHEN b.poster_ids THEN p.poster_id ELSE '' END AS poster_id,
+	CASE WHEN b.poster_ids THEN poster.count ELSE 0 END AS poster_id_count,`+pollJSON+` AS poll
 	FROM threads AS t,
 	LATERAL
-		   (SELECT id, author, body_html, tripcode, file_name, thumbnail_name, created
+		   (SELECT id, author, body_html, tripcode, capcode, is_edited, poster_id, file_name, file_spoiler, `+publicFileMetadata+`, created,
+			`+publicThumbnail+`
 			 FROM posts AS pos
 			 WHERE pos.thread_id = t.id
-			 ORDER BY created ASC
+			 ORDER BY is_op DESC, created ASC
 			 LIMIT 1) AS p,
 	LATERAL
 		   (SELECT created
@@ -27,7 +33,7 @@ func (r *Repository) GetThreads(boardURI string, page int) ([]ThreadWithOP, erro
 			ORDER BY pos.created DESC
 			 LIMIT 1) AS lp,
  	LATERAL
- 		   (SELECT id
+ 		   (SELECT id, poster_ids
  			FROM boards AS bo
 			 WHERE bo.uri = $1) AS b,
 	LATERAL
@@ -37,7 +43,11 @@ func (r *Repository) GetThreads(boardURI string, page int) ([]ThreadWithOP, erro
     LATERAL
 			 (SELECT COUNT(id)
 			  FROM posts
-			  WHERE thread_id = t.id AND file_name <> '') AS images
+			  WHERE thread_id = t.id AND file_name <> '') AS images,
+	LATERAL
+			 (SELECT COUNT(id)
+			  FROM posts
+			  WHERE thread_id = t.id AND poster_id = p.poster_id AND deleted IS NOT true) AS poster
 	WHERE b.id = t.board_id AND t.deleted IS NOT true
 	ORDER BY t.is_sticky DESC, lp.created DESC
 	LIMIT $2 OFFSET $2*($3-1)`, boardURI, pageSize, page)
@@ -48,50 +58,92 @@ func (r *Repository) GetThreads(boardURI string, page int) ([]ThreadWithOP, erro
 func (r *Repository) GetThread(ThreadID int) (ThreadWithPosts, error) {
 	var thread ThreadWithPosts
 	err := r.db.Get(&thread, `
-	SELECT subject, is_sticky, is_locked, 
+	SELECT subject, is_sticky, is_locked, is_autosage, is_cyclical, COALESCE(moved_to, 0) AS moved_to,`+pollJSON+` AS poll,
 	(SELECT json_agg(row_to_json(p))
-	FROM (SELECT id, author, body_html, tripcode, file_name, thumbnail_name, file_original_name, 
-		created, (SELECT array_agg(r.reply_id) FROM (SELECT reply_id FROM replies WHERE post_id = id) AS r) AS replies
+	FROM (SELECT id, author, body_html, tripcode, capcode, is_edited, file_name, file_spoiler, `+publicFileMetadata+`,
+		CASE WHEN b.hide_file_names THEN '' ELSE file_original_name END AS file_original_name,
+		`+publicThumbnail+`,
+		created, (SELECT array_agg(r.reply_id) FROM (SELECT reply_id FROM replies WHERE post_id = id) AS r) AS replies,
+		CASE WHEN b.poster_ids THEN poster_id END AS poster_id,
+		CASE WHEN b.poster_ids THEN (SELECT COUNT(id) FROM posts AS pos
+			WHERE pos.thread_id = t.id AND pos.poster_id = posts.poster_id AND pos.deleted IS NOT true)
+		END AS poster_id_count
 		FROM posts
 		WHERE posts.thread_id = t.id AND posts.deleted IS NOT true
-		ORDER BY created ASC) AS p
+		ORDER BY is_op DESC, created ASC) AS p
 	) AS posts 
 	FROM threads AS t
+	INNER JOIN boards AS b ON b.id = t.board_id
 	WHERE t.id = $1 AND t.deleted IS NOT true`, ThreadID)
 	return thread, err
 }
 
-// CreateThread create a thread and the first post
-func (r *Repository) CreateThread(ti ThreadInsert, pi PostInsert) (int, error) {
+// CreateThread create a thread and the first post, it returns the ids of both
+// and the id of the thumbnail job of the file of the post
+func (r *Repository) CreateThread(ti ThreadInsert, pi PostInsert) (int, int, int, error) {
 	tx := r.db.MustBegin()
 	var threadID int
 
+	ti.PosterIDEpoch = utils.PosterIDEpoch(time.Now())
 	rows, err := tx.NamedQuery(`
-	INSERT INTO threads (board_id, subject, is_sticky, is_locked)
-	SELECT id, :subject, :is_sticky, :is_locked  FROM boards WHERE uri = :board_uri 
+	INSERT INTO threads (board_id, subject, is_sticky, is_locked, poster_id_epoch)
+	SELECT id, :subject, :is_sticky, :is_locked, :poster_id_epoch FROM boards WHERE uri = :board_uri 
 	RETURNING id`, ti)
 	if err != nil {
 		tx.Rollback()
-		return 0, err
+		return 0, 0, 0, err
 	}
 	if !rows.Next() {
 		tx.Rollback()
-		return 0, errors.New("board not exists")
+		return 0, 0, 0, errors.New("board not exists")
 	}
 	rows.Scan(&threadID)
 	rows.Close()
+	if ti.Poll != nil {
+		if err = createPoll(tx, threadID, *ti.Poll); err != nil {
+			tx.Rollback()
+			return 0, 0, 0, err
+		}
+	}
 	pi.ThreadID = threadID
 	pi.AuthorID = utils.EncryptString(pi.IP)
+	pi.PosterID = utils.PosterID(pi.IP, threadID, ti.PosterIDEpoch)
 
-	_, err = tx.NamedExec(`
-	INSERT INTO posts (thread_id, author, body, body_html, tripcode, ip, author_id, bump, created, file_name, file_original_name, thumbnail_name)
-	VALUES (:thread_id, :author, :body, :body_html, :tripcode, :ip, :author_id, :bump, current_timestamp, :file_name, :file_original_name, :thumbnail_name)`, pi)
+	var postID int
+	rows, err = tx.NamedQuery(`
+	INSERT INTO posts (thread_id, author, body, body_html, tripcode, capcode, ip, author_id, poster_id, bump, created, file_name, file_original_name, thumbnail_name, file_spoiler,
+		`+fileMetadata+`, is_op)
+	VALUES (:thread_id, :author, :body, :body_html, :tripcode, :capcode, :ip, :author_id, :poster_id, :bump, current_timestamp, :file_name, :file_original_name, :thumbnail_name, :file_spoiler,
+		:file_size, :file_width, :file_height, :file_duration, :thumbnail_width, :thumbnail_height, :file_processing, true)
+	RETURNING id`, pi)
 	if err != nil {
 		tx.Rollback()
-		return 0, err
+		return 0, 0, 0, err
+	}
+	rows.Next()
+	rows.Scan(&postID)
+	rows.Close()
+	if err = insertReplies(tx, postID, pi.Replies); err != nil {
+		tx.Rollback()
+		return 0, 0, 0, err
+	}
+	jobID, err := createThumbnailJob(tx, postID, pi)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, 0, err
 	}
 	err = tx.Commit()
-	return threadID, err
+	return threadID, postID, jobID, err
+}
+
+// GetThreadBoard returns the board of the thread
+func (r *Repository) GetThreadBoard(threadID int) (ThreadBoard, error) {
+	var board ThreadBoard
+	err := r.db.Get(&board, `
+	SELECT `+boardColumns+`, threads.is_cyclical FROM threads
+	INNER JOIN boards ON boards.id = threads.board_id
+	WHERE threads.id = $1`, threadID)
+	return board, err
 }
 
 func (r *Repository) GetTrendingThreads() ([]TrendingThread, error) {
@@ -106,10 +158,10 @@ func (r *Repository) GetTrendingThreads() ([]TrendingThread, error) {
 		ORDER BY created DESC
 		LIMIT 1) AS new_post,
 	LATERAL
-	(SELECT thumbnail_name, created
+	(SELECT `+publicThumbnail+`, created
 		FROM posts
 		WHERE thread_id = t.id
-		ORDER BY created ASC
+		ORDER BY is_op DESC, created ASC
 		LIMIT 1) AS op,
      LATERAL 
      (SELECT uri
@@ -125,15 +177,18 @@ func (r *Repository) GetTrendingThreads() ([]TrendingThread, error) {
 func (r *Repository) GetThreadsManage(boardURI string, page int) ([]ThreadManageWithOP, error) {
 	var threads []ThreadManageWithOP
 	err := r.db.Select(&threads, `
-	SELECT t.id, t.subject, t.is_sticky, t.is_locked, p.id AS post_id, p.author, p.body_html, p.tripcode, p.author_id, p.file_name, p.thumbnail_name, 
-	p.created, posts.count - 1 as posts_count, images.count - 1 as images_count, p.reports
+	SELECT t.id, t.subject, t.is_sticky, t.is_locked, t.is_autosage, t.is_cyclical, COALESCE(t.moved_to, 0) AS moved_to, p.id AS post_id, p.author, p.body_html, p.tripcode, p.capcode, p.is_edited, p.author_id, p.file_name, p.thumbnail_name, p.file_spoiler, 
+	p.file_size, p.file_width, p.file_height, p.file_duration, p.thumbnail_width, p.thumbnail_height,
+	p.created, posts.count - 1 as posts_count, images.count - 1 as images_count, p.reports,`+pollJSON+` AS poll
 	FROM threads AS t,
 	LATERAL
-		   (SELECT id, author, body_html, tripcode, author_id, file_name, thumbnail_name, created,
-			(SELECT json_agg(row_to_json(r)) FROM (SELECT id, reason, author_id, created FROM reports WHERE post_id=pos.id AND dismissed=false) AS r) AS reports
+		   (SELECT id, author, body_html, tripcode, capcode, is_edited, author_id, file_name, thumbnail_name, file_spoiler, `+fileMetadata+`, created,
+			(SELECT json_agg(row_to_json(r)) FROM (SELECT reports.id, reason, c.name AS category, c.weight, author_id, created FROM reports
+				LEFT JOIN report_categories AS c ON c.id=category_id
+				WHERE post_id=pos.id AND dismissed=false AND actioned=false) AS r) AS reports
 			 FROM posts AS pos
 			 WHERE pos.thread_id = t.id
-			 ORDER BY created ASC
+			 ORDER BY is_op DESC, created ASC
 			 LIMIT 1) AS p,
 	LATERAL
 		   (SELECT created
@@ -163,14 +218,16 @@ func (r *Repository) GetThreadsManage(boardURI string, page int) ([]ThreadManage
 func (r *Repository) GetThreadManage(ThreadID int) (ThreadWithPosts, error) {
 	var thread ThreadWithPosts
 	err := r.db.Get(&thread, `
-	SELECT subject, is_sticky, is_locked, 
+	SELECT subject, is_sticky, is_locked, is_autosage, is_cyclical, COALESCE(moved_to, 0) AS moved_to,`+pollJSON+` AS poll,
 	(SELECT json_agg(row_to_json(p))
-	FROM (SELECT id, author, body_html, tripcode, author_id, file_name, thumbnail_name, file_original_name, 
+	FROM (SELECT id, author, body_html, tripcode, capcode, is_edited, author_id, file_name, thumbnail_name, file_original_name, file_spoiler, `+fileMetadata+`,
 		created, (SELECT array_agg(r.reply_id) FROM (SELECT reply_id FROM replies WHERE post_id = posts.id) AS r) AS replies,
-		(SELECT json_agg(row_to_json(r)) FROM (SELECT id, reason, author_id, created FROM reports WHERE post_id=posts.id AND dismissed=false) AS r) AS reports
+		(SELECT json_agg(row_to_json(r)) FROM (SELECT reports.id, reason, c.name AS category, c.weight, author_id, created FROM reports
+				LEFT JOIN report_categories AS c ON c.id=category_id
+				WHERE post_id=posts.id AND dismissed=false AND actioned=false) AS r) AS reports
 		 FROM posts 
 		 WHERE posts.thread_id = t.id AND posts.deleted IS NOT true
-		 ORDER BY created ASC) AS p
+		 ORDER BY is_op DESC, created ASC) AS p
 	) AS posts 
 	FROM threads AS t
 	WHERE t.id = $1 AND t.deleted IS NOT true`, ThreadID)
@@ -179,10 +236,24 @@ func (r *Repository) GetThreadManage(ThreadID int) (ThreadWithPosts, error) {
 
 // MarkThreadDeleted if user has permission on board
 func (r *Repository) MarkThreadDeleted(threadID int, boards pq.Int64Array) error {
-	_, err := r.db.Exec(`
-			UPDATE threads SET deleted=true
-			WHERE board_id=ANY($2) AND id=$1`,
+	tx := r.db.MustBegin()
+	var deleted pq.Int64Array
+	err := tx.Get(&deleted, `
+			WITH t AS (UPDATE threads SET deleted=true
+			WHERE board_id=ANY($2) AND id=$1
+			RETURNING id)
+			SELECT array_agg(posts.id) FROM posts
+			INNER JOIN t ON t.id=posts.thread_id`,
 		threadID, boards)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = actionReports(tx, deleted); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
 	return err
 
 }
@@ -225,6 +296,41 @@ func (r *Repository) ToggleSticky(threadID int, boards pq.Int64Array) error {
 	return err
 }
 
+func (r *Repository) ToggleAutosage(threadID int, boards pq.Int64Array) error {
+	_, err := r.db.Exec(`
+			UPDATE threads SET is_autosage = NOT is_autosage
+			WHERE board_id=ANY($2) AND id=$1`,
+		threadID, boards)
+	return err
+}
+
+func (r *Repository) ToggleCyclical(threadID int, boards pq.Int64Array) error {
+	_, err := r.db.Exec(`
+			UPDATE threads SET is_cyclical = NOT is_cyclical
+			WHERE board_id=ANY($2) AND id=$1`,
+		threadID, boards)
+	return err
+}
+
+// PruneCyclicalThread marks the oldest replies of a cyclical thread as deleted
+// until it has at most limit posts, the OP is always kept. returns the number of pruned replies,
+// they are removed with their files like other deleted posts
+func (r *Repository) PruneCyclicalThread(threadID int, limit int) (int64, error) {
+	res, err := r.db.Exec(`
+	UPDATE posts SET deleted=true
+	WHERE id IN (
+		SELECT pos.id FROM posts AS pos
+		INNER JOIN threads AS t ON t.id = pos.thread_id
+		WHERE t.id = $1 AND t.is_cyclical = true AND pos.deleted IS NOT true
+		AND pos.id <> (SELECT id FROM posts WHERE thread_id = $1 ORDER BY is_op DESC, created ASC LIMIT 1)
+		ORDER BY pos.created DESC
+		OFFSET GREATEST($2, 1) - 1)`, threadID, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (r *Repository) ToggleLock(threadID int, boards pq.Int64Array) error {
 	_, err := r.db.Exec(`
 			UPDATE threads SET is_locked = NOT is_locked
@@ -232,3 +338,213 @@ func (r *Repository) ToggleLock(threadID int, boards pq.Int64Array) error {
 		threadID, boards)
 	return err
 }
+
+// MoveThread moves the thread to another board if user has permission on both boards,
+// returns the URIs of the old and the new board
+func (r *Repository) MoveThread(tm ThreadMove, boards pq.Int64Array) (string, string, error) {
+	tx := r.db.MustBegin()
+	var from struct {
+		BoardID  int    `json:"board_id"`
+		BoardURI string `json:"board_uri"`
+	}
+	err := tx.Get(&from, `
+	SELECT boards.id AS board_id, boards.uri AS board_uri FROM threads
+	INNER JOIN boards ON boards.id=threads.board_id
+	WHERE threads.id=$1 AND threads.board_id=ANY($2) AND threads.deleted IS NOT true
+	FOR UPDATE OF threads`, tm.ThreadID, boards)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	res, err := tx.Exec(`
+	UPDATE threads SET board_id=boards.id
+	FROM boards
+	WHERE threads.id=$1 AND boards.uri=$2 AND boards.id=ANY($3) AND boards.id<>threads.board_id`,
+		tm.ThreadID, tm.BoardURI, boards)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return "", "", errors.New("board not exists")
+	}
+	// the replies are kept, the quotes of the posts of the thread link to the new board
+	if err = retargetReplies(tx, tm.ThreadID); err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+
+	if tm.StubBody != "" {
+		// the stub is a locked thread in the old board with a single post
+		// that is copied from the OP of the moved thread
+		var stubID int
+		err = tx.Get(&stubID, `
+		INSERT INTO threads (board_id, subject, is_sticky, is_locked, moved_to)
+		SELECT $1, subject, false, true, id FROM threads WHERE id=$2
+		RETURNING id`, from.BoardID, tm.ThreadID)
+		if err != nil {
+			tx.Rollback()
+			return "", "", err
+		}
+		_, err = tx.Exec(`
+		INSERT INTO posts (thread_id, author, body, body_html, tripcode, ip, author_id, poster_id, bump, created, file_name, file_original_name, thumbnail_name, is_op)
+		SELECT $1, author, $2, $3, tripcode, ip, author_id, poster_id, true, current_timestamp, '', '', '', true
+		FROM posts WHERE thread_id=$4
+		ORDER BY is_op DESC, created ASC LIMIT 1`, stubID, tm.StubBody, tm.StubBodyHTML, tm.ThreadID)
+		if err != nil {
+			tx.Rollback()
+			return "", "", err
+		}
+	}
+	err = tx.Commit()
+	return from.BoardURI, tm.BoardURI, err
+}
+
+// MergeThreads moves all the posts of the thread into the target thread
+// if user has permission on both boards, returns the URIs of their boards.
+// the OP of the target thread stays its first post, the merged thread is left
+// with a stub post and redirects to the target thread
+func (r *Repository) MergeThreads(tm ThreadMerge, boards pq.Int64Array) (string, string, error) {
+	tx := r.db.MustBegin()
+	var uris []string
+	err := tx.Select(&uris, `
+	SELECT boards.uri FROM threads
+	INNER JOIN boards ON boards.id=threads.board_id
+	WHERE threads.id=ANY($1) AND threads.board_id=ANY($2) AND threads.deleted IS NOT true
+	ORDER BY threads.id=$3 DESC
+	FOR UPDATE OF threads`, pq.Int64Array{int64(tm.ThreadID), int64(tm.TargetID)}, boards, tm.ThreadID)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	if tm.ThreadID == tm.TargetID || len(uris) != 2 {
+		tx.Rollback()
+		return "", "", errors.New("thread not exists")
+	}
+	var opID int
+	err = tx.Get(&opID, `
+	SELECT id FROM posts WHERE thread_id=$1
+	ORDER BY is_op DESC, created ASC LIMIT 1`, tm.ThreadID)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	_, err = tx.Exec(`UPDATE posts SET thread_id=$2, is_op=false WHERE thread_id=$1`, tm.ThreadID, tm.TargetID)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	if err = retargetReplies(tx, tm.TargetID); err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	_, err = tx.Exec(`
+	UPDATE threads SET moved_to=$2, is_locked=true, is_sticky=false
+	WHERE id=$1`, tm.ThreadID, tm.TargetID)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	// the stub is copied from the old OP so the merged thread is still listed
+	_, err = tx.Exec(`
+	INSERT INTO posts (thread_id, author, body, body_html, tripcode, ip, author_id, poster_id, bump, created, file_name, file_original_name, thumbnail_name, is_op)
+	SELECT $1, author, $2, $3, tripcode, ip, author_id, poster_id, true, current_timestamp, '', '', '', true
+	FROM posts WHERE id=$4`, tm.ThreadID, tm.StubBody, tm.StubBodyHTML, opID)
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	err = tx.Commit()
+	return uris[0], uris[1], err
+}
+
+// SplitThread moves the post and all the posts after it into a new thread
+// if user has permission on the board, returns the new thread ID and the board URI
+func (r *Repository) SplitThread(threadID int, postID int, subject string, boards pq.Int64Array) (int, string, error) {
+	tx := r.db.MustBegin()
+	var newThread struct {
+		ID       int    `json:"id"`
+		BoardURI string `json:"board_uri"`
+	}
+	err := tx.Get(&newThread, `
+	INSERT INTO threads (board_id, subject, is_sticky, is_locked, poster_id_epoch)
+	SELECT board_id, $2, false, false, $4 FROM threads
+	WHERE id=$1 AND board_id=ANY($3) AND deleted IS NOT true
+	RETURNING id, (SELECT uri FROM boards WHERE boards.id=board_id) AS board_uri`,
+		threadID, subject, boards, utils.PosterIDEpoch(time.Now()))
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	// the OP can not be moved since the thread would be left empty,
+	// the post becomes the OP of the new thread
+	res, err := tx.Exec(`
+	UPDATE posts SET thread_id=$3, is_op=(posts.id=$2)
+	FROM (SELECT created FROM posts WHERE id=$2 AND thread_id=$1) AS split,
+		(SELECT id FROM posts WHERE thread_id=$1 ORDER BY is_op DESC, created ASC LIMIT 1) AS op
+	WHERE posts.thread_id=$1 AND posts.created >= split.created
+	AND posts.id <> op.id AND $2 <> op.id`,
+		threadID, postID, newThread.ID)
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return 0, "", errors.New("post not exists")
+	}
+	if err = retargetReplies(tx, newThread.ID); err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	err = tx.Commit()
+	return newThread.ID, newThread.BoardURI, err
+}
+
+// retargetReplies updates the rendered quotes of the posts of the thread
+// after the posts were moved into the thread, the replies table is kept as is
+// since the moved posts keep their IDs
+func retargetReplies(tx *sqlx.Tx, threadID int) error {
+	var targets []utils.QuoteTarget
+	err := tx.Select(&targets, `
+	SELECT posts.id AS post_id, threads.id AS thread_id, boards.uri AS board_uri FROM posts
+	INNER JOIN threads ON threads.id = posts.thread_id
+	INNER JOIN boards ON boards.id = threads.board_id
+	WHERE threads.id = $1`, threadID)
+	if err != nil {
+		return err
+	}
+	moved := make(map[int64]utils.QuoteTarget, len(targets))
+	for _, t := range targets {
+		moved[t.PostID] = t
+	}
+	var quoting []struct {
+		ID       int64  `json:"id"`
+		BodyHTML string `json:"body_html"`
+	}
+	err = tx.Select(&quoting, `
+	SELECT id, body_html FROM posts
+	WHERE id IN (SELECT reply_id FROM replies
+		INNER JOIN posts ON posts.id = replies.post_id
+		WHERE posts.thread_id = $1)`, threadID)
+	if err != nil {
+		return err
+	}
+	ids := pq.Int64Array{}
+	bodies := pq.StringArray{}
+	for _, q := range quoting {
+		if html := utils.RetargetReplies(q.BodyHTML, moved); html != q.BodyHTML {
+			ids = append(ids, q.ID)
+			bodies = append(bodies, html)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+	UPDATE posts SET body_html = u.body_html
+	FROM unnest($1::int[], $2::text[]) AS u(id, body_html)
+	WHERE posts.id = u.id`, ids, bodies)
+	return err
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"gitlab.com/noamdb/modernboard/utils"
+)
+
+// GetTokenUser returns the user of the API token with only the capabilities and boards of the token.
+// tokens that are limited to boards have no capabilities outside of the boards
+func (r *Repository) GetTokenUser(hash string) (User, error) {
+	var p User
+	var allBoards bool
+	var capabilities pq.StringArray
+	var boards pq.Int64Array
+	err := r.db.QueryRowx(`
+	SELECT users.id, users.name, users.role, users.password, roles.capabilities, roles.all_boards, api_tokens.id,
+	users.totp_enabled, roles.require_2fa, api_tokens.capabilities, api_tokens.boards
+	FROM api_tokens
+	INNER JOIN users ON users.id = api_tokens.user_id
+	INNER JOIN roles ON roles.name = users.role
+	WHERE api_tokens.token_hash = $1
+	AND (api_tokens.expires IS NULL OR api_tokens.expires > current_timestamp)`, hash).Scan(
+		&p.ID, &p.Name, &p.Role, &p.Password, &p.Capabilities, &allBoards, &p.TokenID,
+		&p.TwoFactorEnabled, &p.TwoFactorRequired, &capabilities, &boards)
+	if err != nil {
+		return p, err
+	}
+	if err = r.loadBoardCapabilities(&p, allBoards); err != nil {
+		return p, err
+	}
+
+	limited := []BoardCapabilities{}
+	for _, b := range p.BoardCapabilities {
+		if len(boards) == 0 || containsInt64(boards, b.BoardID) {
+			b.Capabilities = utils.LimitCapabilities(b.Capabilities, capabilities)
+			limited = append(limited, b)
+		}
+	}
+	p.BoardCapabilities = limited
+	if len(boards) == 0 {
+		p.Capabilities = utils.LimitCapabilities(p.Capabilities, capabilities)
+	} else {
+		p.Capabilities = pq.StringArray{}
+	}
+	return p, nil
+}
+
+func containsInt64(a []int64, n int64) bool {
+	for _, v := range a {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// UseAPIToken updates the last use of the token and records it in the audit log,
+// at most once a minute so bots don't flood the log
+func (r *Repository) UseAPIToken(userID int, tokenID int, IP string) error {
+	tx := r.db.MustBegin()
+	res, err := tx.Exec(`
+	UPDATE api_tokens SET last_used = current_timestamp
+	WHERE id = $1 AND (last_used IS NULL OR last_used < current_timestamp - interval '1 minute')`, tokenID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return tx.Rollback()
+	}
+	err = insertAudit(tx, AuditInsert{Event: AuditTokenUsed, UserID: userID, TokenID: tokenID, IP: IP})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) GetAPITokens(userID int) ([]APIToken, error) {
+	var t []APIToken
+	err := r.db.Select(&t, `
+	SELECT api_tokens.id, api_tokens.name, api_tokens.capabilities,
+	ARRAY(SELECT uri FROM boards WHERE boards.id = ANY(api_tokens.boards) ORDER BY boards.id) AS boards,
+	api_tokens.expires, api_tokens.last_used, api_tokens.created
+	FROM api_tokens
+	WHERE user_id = $1
+	ORDER BY created DESC`, userID)
+	return t, err
+}
+
+func (r *Repository) CreateAPIToken(ti APITokenInsert) (int, error) {
+	var id int
+	rows, err := r.db.NamedQuery(`
+	INSERT INTO api_tokens (user_id, name, token_hash, capabilities, boards, expires, created)
+	VALUES (:user_id, :name, :token_hash, :capabilities, :boards, :expires, current_timestamp)
+	RETURNING id`, ti)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("token was not created")
+	}
+	err = rows.Scan(&id)
+	return id, err
+}
+
+// DeleteAPIToken deletes a token of the user
+func (r *Repository) DeleteAPIToken(userID int, tokenID int) error {
+	res, err := r.db.Exec(`DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("token not exists")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// GetTwoFactorLogin returns the session of the token if it waits for the 2FA code
+func (r *Repository) GetTwoFactorLogin(token string) (TwoFactorLogin, error) {
+	var l TwoFactorLogin
+	err := r.db.Get(&l, `
+	SELECT sessions.id AS session_id, users.id AS user_id, users.role, users.totp_secret
+	FROM sessions
+	INNER JOIN users ON users.id = sessions.user_id
+	WHERE sessions.token = $1 AND sessions.two_factor_pending = true
+	AND sessions.expires > current_timestamp AND users.totp_enabled = true`, token)
+	return l, err
+}
+
+// VerifyTwoFactorLogin makes the session a regular session that expires at expires
+func (r *Repository) VerifyTwoFactorLogin(sessionID int, expires time.Time) error {
+	_, err := r.db.Exec(`
+	UPDATE sessions SET two_factor_pending = false, last_seen = current_timestamp, expires = $2
+	WHERE id = $1 AND two_factor_pending = true`, sessionID, expires)
+	return err
+}
+
+// FailTwoFactorLogin counts a wrong code, the session is deleted after maxAttempts
+func (r *Repository) FailTwoFactorLogin(sessionID int, maxAttempts int) error {
+	_, err := r.db.Exec(`
+	DELETE FROM sessions
+	WHERE id = $1 AND two_factor_pending = true AND two_factor_attempts + 1 >= $2`, sessionID, maxAttempts)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`
+	UPDATE sessions SET two_factor_attempts = two_factor_attempts + 1
+	WHERE id = $1 AND two_factor_pending = true`, sessionID)
+	return err
+}
+
+// UseTOTPPeriod saves the period of a valid code, it fails if a code of the period
+// or of a later period was already used
+func (r *Repository) UseTOTPPeriod(userID int, period int64) error {
+	res, err := r.db.Exec(`
+	UPDATE users SET totp_last_period = $2
+	WHERE id = $1 AND totp_last_period < $2`, userID, period)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("code was already used")
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code of the hash, it fails if the user has no such code
+func (r *Repository) UseRecoveryCode(userID int, hash string) error {
+	res, err := r.db.Exec(`
+	UPDATE users SET recovery_codes = array_remove(recovery_codes, $2)
+	WHERE id = $1 AND $2 = ANY(recovery_codes)`, userID, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("recovery code not exists")
+	}
+	return nil
+}
+
+// SetTOTPSecret starts the enrollment with a new secret, it fails if 2FA is enabled
+func (r *Repository) SetTOTPSecret(userID int, secret string) error {
+	res, err := r.db.Exec(`
+	UPDATE users SET totp_secret = $2
+	WHERE id = $1 AND totp_enabled = false`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("2FA is enabled")
+	}
+	return nil
+}
+
+func (r *Repository) GetTOTPSecret(userID int) (string, error) {
+	var secret string
+	err := r.db.Get(&secret, `SELECT totp_secret FROM users WHERE id = $1`, userID)
+	return secret, err
+}
+
+// EnableTwoFactor enables 2FA with the secret of the enrollment and replaces the recovery codes
+func (r *Repository) EnableTwoFactor(userID int, period int64, recoveryCodes pq.StringArray) error {
+	res, err := r.db.Exec(`
+	UPDATE users SET totp_enabled = true, totp_last_period = $2, recovery_codes = $3
+	WHERE id = $1 AND totp_enabled = false AND totp_secret != ''`, userID, period, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("no 2FA enrollment")
+	}
+	return nil
+}
+
+// DisableTwoFactor removes the secret and the recovery codes of the user
+func (r *Repository) DisableTwoFactor(userID int) error {
+	return disableTwoFactor(r.db, userID)
+}
+
+func disableTwoFactor(db sqlx.Execer, userID int) error {
+	_, err := db.Exec(`
+	UPDATE users SET totp_enabled = false, totp_secret = '', totp_last_period = 0, recovery_codes = '{}'
+	WHERE id = $1`, userID)
+	return err
+}
+
+// ResetTwoFactor disables 2FA of the user for an admin and deletes the sessions and the API tokens
+// of the user, they may belong to whoever took the account
+func (r *Repository) ResetTwoFactor(ai AuditInsert) error {
+	tx := r.db.MustBegin()
+	if err := disableTwoFactor(tx, ai.UserID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM sessions WHERE user_id = $1`, ai.UserID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM api_tokens WHERE user_id = $1`, ai.UserID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = insertAudit(tx, ai); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,6 +1,11 @@
 package repository
 
-import "github.com/lib/pq"
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"gitlab.com/noamdb/modernboard/utils"
+)
 
 func (r *Repository) CreateUser(user UserCreate) error {
 	_, err := r.db.NamedExec(`
@@ -13,43 +18,127 @@ func (r *Repository) CreateUser(user UserCreate) error {
 func (r *Repository) GetUser(username string) (UserLoginGet, error) {
 	var u UserLoginGet
 	err := r.db.Get(&u, `
-	SELECT id, role, password FROM users
-	Where name = $1`, username)
+	SELECT users.id, users.role, users.password, users.totp_enabled, roles.require_2fa
+	FROM users
+	INNER JOIN roles ON roles.name = users.role
+	WHERE users.name = $1`, username)
 	return u, err
 }
 
-func (r *Repository) CreateSession(id string, username string) error {
-	_, err := r.db.Exec(`
-	INSERT INTO sessions (id, user_id, created)
-	SELECT $1, id, current_timestamp FROM users WHERE name = $2`, id, username)
+func (r *Repository) CreateSession(si SessionInsert) error {
+	_, err := r.db.NamedExec(`
+	INSERT INTO sessions (token, user_id, user_agent, ip, created, last_seen, expires, two_factor_pending)
+	VALUES (:token, :user_id, :user_agent, :ip, current_timestamp, current_timestamp, :expires,
+		:two_factor_pending)`, si)
 	return err
 }
 
-func (r *Repository) GetUserDetails(session_id string) (User, error) {
+// GetUserDetails returns the user of the session with the effective capabilities of the user
+// on the boards of the user, or on all the boards if the role is of all the boards.
+// the session must not be expired, unused for idleHours or waiting for the 2FA code
+func (r *Repository) GetUserDetails(token string, idleHours int) (User, error) {
 	var p User
-	err := r.db.Get(&p, `	
-	SELECT id, role, password, array_remove(array_agg(b.board_id), NULL) AS boards FROM users
-	INNER JOIN (SELECT user_id FROM sessions
-				WHERE id=$1) AS session
-	ON users.id = session.user_id
-	LEFT JOIN  (
-		SELECT board_id
-		FROM users_boards) as b ON user_id = session.user_id
-		GROUP BY id`, session_id)
+	var allBoards bool
+	err := r.db.QueryRowx(`
+	SELECT users.id, users.name, users.role, users.password, roles.capabilities, roles.all_boards, sessions.id,
+	users.totp_enabled, roles.require_2fa
+	FROM sessions
+	INNER JOIN users ON users.id = sessions.user_id
+	INNER JOIN roles ON roles.name = users.role
+	WHERE sessions.token = $1 AND sessions.expires > current_timestamp
+	AND sessions.last_seen > current_timestamp - $2 * interval '1 hour'
+	AND sessions.two_factor_pending = false`, token, idleHours).Scan(
+		&p.ID, &p.Name, &p.Role, &p.Password, &p.Capabilities, &allBoards, &p.SessionID,
+		&p.TwoFactorEnabled, &p.TwoFactorRequired)
+	if err != nil {
+		return p, err
+	}
+	err = r.loadBoardCapabilities(&p, allBoards)
 	return p, err
 }
 
-func (r *Repository) DeleteSession(session string) error {
+// loadBoardCapabilities sets the effective capabilities of the user on the boards of the user,
+// or on all the boards if the role is of all the boards
+func (r *Repository) loadBoardCapabilities(p *User, allBoards bool) error {
+	var boards []struct {
+		BoardID  int64  `json:"board_id"`
+		BoardURI string `json:"board_uri"`
+		BoardOverrides
+	}
+	err := r.db.Select(&boards, `
+	SELECT boards.id AS board_id, boards.uri AS board_uri,
+		COALESCE(users_boards.granted, '{}') AS granted, COALESCE(users_boards.revoked, '{}') AS revoked
+	FROM boards
+	LEFT JOIN users_boards ON users_boards.board_id = boards.id AND users_boards.user_id = $1
+	WHERE users_boards.user_id IS NOT NULL OR $2
+	ORDER BY boards.id`, p.ID, allBoards)
+	if err != nil {
+		return err
+	}
+	p.BoardCapabilities = make([]BoardCapabilities, len(boards))
+	for i, b := range boards {
+		p.BoardCapabilities[i] = BoardCapabilities{BoardID: b.BoardID, BoardURI: b.BoardURI,
+			Capabilities: utils.EffectiveCapabilities(p.Capabilities, b.Granted, b.Revoked)}
+	}
+	return nil
+}
+
+// TouchSession updates the last time the session was used, at most once a minute
+func (r *Repository) TouchSession(sessionID int) error {
+	_, err := r.db.Exec(`
+	UPDATE sessions SET last_seen = current_timestamp
+	WHERE id = $1 AND last_seen < current_timestamp - interval '1 minute'`, sessionID)
+	return err
+}
+
+// GetSessions returns the sessions of the user that didn't expire from the last used,
+// the current session is marked
+func (r *Repository) GetSessions(userID int, currentID int, idleHours int) ([]Session, error) {
+	var s []Session
+	err := r.db.Select(&s, `
+	SELECT id, user_agent, host(ip) AS ip, created, last_seen, expires, id = $2 AS current
+	FROM sessions
+	WHERE user_id = $1 AND expires > current_timestamp AND two_factor_pending = false
+	AND last_seen > current_timestamp - $3 * interval '1 hour'
+	ORDER BY last_seen DESC`, userID, currentID, idleHours)
+	return s, err
+}
+
+func (r *Repository) DeleteSession(token string) error {
+	_, err := r.db.Exec(`
+	DELETE FROM sessions
+	WHERE token = $1`, token)
+	return err
+}
+
+// DeleteUserSession deletes a session of the user
+func (r *Repository) DeleteUserSession(userID int, sessionID int) error {
+	res, err := r.db.Exec(`
+	DELETE FROM sessions
+	WHERE id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("session not exists")
+	}
+	return nil
+}
+
+// DeleteUserSessions deletes all the sessions of the user except the session with exceptID
+func (r *Repository) DeleteUserSessions(userID int, exceptID int) error {
 	_, err := r.db.Exec(`
 	DELETE FROM sessions
-	WHERE id = $1`, session)
+	WHERE user_id = $1 AND id != $2`, userID, exceptID)
 	return err
 }
 
-func (r *Repository) DeleteOldSessions(days int) error {
+// DeleteExpiredSessions deletes the sessions that expired or weren't used for idleHours
+func (r *Repository) DeleteExpiredSessions(idleHours int) error {
 	_, err := r.db.Exec(`
 	DELETE FROM sessions
-	WHERE created < current_date - $1 * interval '1 day'`, days)
+	WHERE expires < current_timestamp
+	OR last_seen < current_timestamp - $1 * interval '1 hour'`, idleHours)
 	return err
 }
 
@@ -62,7 +151,26 @@ func (r *Repository) ChangePassword(userID int, newPassword string) error {
 
 func (r *Repository) GetUsers() ([]UserSelect, error) {
 	var u []UserSelect
-	err := r.db.Select(&u, `SELECT id, name, role, created FROM users`)
+	err := r.db.Select(&u, `
+	SELECT id, name, role, created FROM users`)
+	if err != nil {
+		return u, err
+	}
+	keys := make(pq.StringArray, len(u))
+	for i, user := range u {
+		keys[i] = loginKey("name", user.Name)
+	}
+	var locked []string
+	err = r.db.Select(&locked, `
+	SELECT key_hash FROM login_attempts
+	WHERE key_hash = ANY($1) AND locked = true AND blocked_until > current_timestamp`, keys)
+	lockedKeys := make(map[string]bool, len(locked))
+	for _, key := range locked {
+		lockedKeys[key] = true
+	}
+	for i := range u {
+		u[i].Locked = lockedKeys[keys[i]]
+	}
 	return u, err
 }
 
@@ -74,7 +182,7 @@ func (r *Repository) DeleteUser(userID int) error {
 func (r *Repository) GetBoardUsers(boardURI string, boards pq.Int64Array) ([]BoardUser, error) {
 	var u []BoardUser
 	err := r.db.Select(&u, `
-	SELECT users.id, name, role, users_boards.created FROM users
+	SELECT users.id, name, role, users_boards.created, granted, revoked FROM users
 	INNER JOIN boards ON uri=$1 AND boards.id=ANY($2)
 	INNER JOIN users_boards ON user_id=users.id AND board_id=boards.id`, boardURI, boards)
 	return u, err
@@ -85,16 +193,40 @@ func (r *Repository) DeleteBoardUser(boardURI string, userID int, boards pq.Int6
 	DELETE FROM users_boards
 	WHERE board_id = (SELECT boards.id FROM boards WHERE boards.uri=$1 AND boards.id=ANY($3))
 	AND EXISTS((SELECT users.id FROM users WHERE users.id=$2 AND users.role!='admin'))
-	AND user_id=2`, boardURI, userID, boards)
+	AND user_id=$2`, boardURI, userID, boards)
 	return err
 }
 
+// UpdateBoardUser sets the capabilities that are granted to the user and revoked from the user on the board,
+// the capabilities of admins can't be changed
+func (r *Repository) UpdateBoardUser(boardURI string, userID int, bo BoardOverrides, boards pq.Int64Array) error {
+	res, err := r.db.Exec(`
+	UPDATE users_boards SET granted=$3, revoked=$4
+	WHERE board_id = (SELECT boards.id FROM boards WHERE boards.uri=$1 AND boards.id=ANY($5))
+	AND EXISTS((SELECT users.id FROM users WHERE users.id=$2 AND users.role!='admin'))
+	AND user_id=$2`, boardURI, userID, bo.Granted, bo.Revoked, boards)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("board user not exists")
+	}
+	return nil
+}
+
+// CreateBoardUser adds the user to the board, admins can't be added since
+// they have all the capabilities on all the boards
 func (r *Repository) CreateBoardUser(uri string, name string, boards pq.Int64Array) error {
-	_, err := r.db.Exec(`
+	res, err := r.db.Exec(`
 	INSERT INTO users_boards (board_id, user_id, created)
-	SELECT (SELECT boards.id FROM boards WHERE boards.uri=$1 AND boards.id=ANY($3)),
-	(SELECT users.id FROM users WHERE users.name=$2), current_timestamp`,
+	SELECT boards.id, users.id, current_timestamp FROM boards, users
+	WHERE boards.uri=$1 AND boards.id=ANY($3) AND users.name=$2 AND users.role!='admin'`,
 		uri, name, boards)
-
-	return err
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("user not exists")
+	}
+	return nil
 }
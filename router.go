@@ -9,13 +9,11 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"gitlab.com/noamdb/modernboard/cache"
 	"gitlab.com/noamdb/modernboard/controllers"
+	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/repository"
 )
 
-func NewRouter(repo *repository.Repository) *chi.Mux {
-	c := &cache.Cache{Repository: repo}
-	c.Init()
-
+func NewRouter(repo *repository.Repository, c *cache.Cache, mq *media.Queue) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -29,27 +27,37 @@ func NewRouter(repo *repository.Repository) *chi.Mux {
 		w.Write([]byte("."))
 	})
 
-	threadR := controllers.ThreadsResource{repo, c.ThreadsPageCache, c.ThreadCache}
-	usersR := controllers.UsersResource{repo}
-	boardsR := controllers.BoardsResource{repo, c.BoardsCache}
-	r.Mount("/static", controllers.FilesResource{}.Routes())
-	r.Mount("/home", controllers.HomeResource{repo, c.TrendingThreadsCache}.Routes())
+	threadR := controllers.ThreadsResource{Repo: repo, ThreadsPageC: c.ThreadsPageCache,
+		ThreadCacheC: c.ThreadCache, MediaQ: mq}
+	postsR := controllers.PostsResource{Repo: repo, ThreadsPageC: c.ThreadsPageCache,
+		ThreadCacheC: c.ThreadCache, MediaQ: mq}
+	usersR := controllers.UsersResource{Repo: repo}
+	boardsR := controllers.BoardsResource{Repo: repo, BoardsC: c.BoardsCache}
+	r.Mount("/static", controllers.FilesResource{Repo: repo, Storage: media.GetStorage()}.Routes())
+	r.Mount("/media", controllers.MediaResource{Repo: repo}.Routes())
+	r.Mount("/home", controllers.HomeResource{Repo: repo, TrendingThreadsC: c.TrendingThreadsCache}.Routes())
 	r.Mount("/users", usersR.Routes())
-	r.Mount("/ban", controllers.BansResource{repo, c.BanCache}.Routes())
+	r.Mount("/roles", controllers.RolesResource{Repo: repo}.Routes())
+	r.Mount("/ban", controllers.BansResource{Repo: repo, Bc: c.BanCache,
+		ThreadsPageC: c.ThreadsPageCache, ThreadCacheC: c.ThreadCache}.Routes())
 	r.Route(`/boards`, func(r chi.Router) {
 		r.Mount("/", boardsR.Routes())
 		r.Mount("/manage", boardsR.ManageRoutes())
 		r.Route(`/{boardURI:[a-zA-z0-9]{1,10}}`, func(r chi.Router) {
 			r.Mount("/threads", threadR.ThreadsRoutes())
 			r.Mount("/users", usersR.BoardRoutes())
+			r.Mount("/settings", boardsR.SettingsRoutes())
+			r.Mount("/reports", controllers.ReportsResource{Repo: repo}.BoardRoutes())
 		})
 		r.Route(`/threads`, func(r chi.Router) {
 			r.Route(`/{threadID:[0-9]+}`, func(r chi.Router) {
-				r.Mount(`/posts`, controllers.PostsResource{repo}.ThreadRoutes())
+				r.Mount(`/posts`, postsR.ThreadRoutes())
+				r.Mount(`/poll`, controllers.PollsResource{Repo: repo,
+					ThreadCacheC: c.ThreadCache}.Routes())
 				r.Mount("/", threadR.ThreadRoutes())
 
 			})
-			r.Mount(`/posts`, controllers.PostsResource{repo}.PostsRoutes())
+			r.Mount(`/posts`, postsR.PostsRoutes())
 
 		})
 	})
@@ -8,6 +8,8 @@ import (
 
 	"github.com/spf13/viper"
 	"github.com/go-chi/chi"
+	"gitlab.com/noamdb/modernboard/cache"
+	"gitlab.com/noamdb/modernboard/media"
 	"gitlab.com/noamdb/modernboard/repository"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -25,9 +27,9 @@ func NewServer(mux *chi.Mux) *http.Server {
 	return &srv
 }
 
-func StartServer(repo *repository.Repository) {
+func StartServer(repo *repository.Repository, c *cache.Cache, mq *media.Queue) {
 	log.Println("configuring server...")
-	api := NewRouter(repo)
+	api := NewRouter(repo, c, mq)
 	server := NewServer(api)
 	if viper.GetString("environment") == "production" {
 		log.Println("configuring tls")
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/spf13/viper"
 	"gitlab.com/noamdb/modernboard/media"
 )
 
@@ -30,7 +31,7 @@ func (t Tasks) ClearPosts() {
 }
 
 func (t Tasks) ClearSessions() {
-	err := t.Repo.DeleteOldSessions(15)
+	err := t.Repo.DeleteExpiredSessions(viper.GetInt("session_idle_hours"))
 	if err != nil {
 		fmt.Println("error while deleting sessions", err.Error())
 		return
@@ -45,6 +46,19 @@ func (t Tasks) ClearBans() {
 	}
 }
 
+// ClearIPs removes the IPs of the posts, reports, sessions and audit events after ip_retention_days, 0 keeps them
+func (t Tasks) ClearIPs() {
+	days := viper.GetInt("ip_retention_days")
+	if days <= 0 {
+		return
+	}
+	err := t.Repo.ClearOldIPs(days)
+	if err != nil {
+		fmt.Println("error while clearing IPs", err.Error())
+		return
+	}
+}
+
 func (t Tasks) RunDBTasks() {
 	ticker := time.NewTicker(time.Hour * 24 * 15)
 	go func() {
@@ -57,3 +71,22 @@ func (t Tasks) RunDBTasks() {
 		}
 	}()
 }
+
+func (t Tasks) ClearLoginAttempts() {
+	err := t.Repo.DeleteOldLoginAttempts()
+	if err != nil {
+		fmt.Println("error while deleting login attempts", err.Error())
+		return
+	}
+}
+
+// RunRetentionTasks runs daily so IPs aren't kept much longer than the retention
+func (t Tasks) RunRetentionTasks() {
+	ticker := time.NewTicker(time.Hour * 24)
+	go func() {
+		for ; true; <-ticker.C {
+			t.ClearIPs()
+			t.ClearLoginAttempts()
+		}
+	}()
+}
@@ -13,4 +13,5 @@ type Tasks struct {
 func (t Tasks) Run() {
 	// go t.RunCacheTasks()
 	go t.RunDBTasks()
+	go t.RunRetentionTasks()
 }
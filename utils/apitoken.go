@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// apiTokenPrefix makes the tokens easy to recognize, for example by secret scanners
+const apiTokenPrefix = "mbt_"
+
+// NewAPIToken returns a random API token of 256 bits
+func NewAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIToken is the hash of the token that is saved instead of the token,
+// the tokens are random so a fast hash is enough
+func HashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,125 @@
+package utils
+
+import "strings"
+
+// maxDiffEdits is the largest number of changed lines that are diffed, bodies that differ
+// by more lines are shown as fully replaced so the diff stays cheap for any input
+const maxDiffEdits = 1000
+
+// DiffLine is a single line of a line based diff,
+// Op is "=" for unchanged lines, "-" for removed lines and "+" for added lines
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// LineDiff returns the shortest diff between the lines of a and b
+func LineDiff(a string, b string) []DiffLine {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix &&
+		x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	var diff []DiffLine
+	for _, l := range x[:prefix] {
+		diff = append(diff, DiffLine{"=", l})
+	}
+	diff = append(diff, editScript(x[prefix:len(x)-suffix], y[prefix:len(y)-suffix])...)
+	for _, l := range x[len(x)-suffix:] {
+		diff = append(diff, DiffLine{"=", l})
+	}
+	return diff
+}
+
+// editScript is the shortest edit script from x to y by the O(ND) algorithm of Myers,
+// the memory is O(D^2) for D edits so x is replaced by y if they differ by more than maxDiffEdits lines
+func editScript(x []string, y []string) []DiffLine {
+	n, m := len(x), len(y)
+	// trace[d][k+d] is the furthest index of x on diagonal k (x-y) after d edits
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && d <= maxDiffEdits && !found; d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var i int
+			switch {
+			case d == 0:
+				i = 0
+			case k == -d || (k != d && trace[d-1][k-1+d-1] < trace[d-1][k+1+d-1]):
+				i = trace[d-1][k+1+d-1]
+			default:
+				i = trace[d-1][k-1+d-1] + 1
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			v[k+d] = i
+			if i >= n && j >= m {
+				found = true
+			}
+		}
+		trace = append(trace, v)
+	}
+	if !found {
+		return replaceLines(x, y)
+	}
+
+	var reversed []DiffLine
+	i, j := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		k := i - j
+		prev := trace[d-1]
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevI := prev[prevK+d-1]
+		prevJ := prevI - prevK
+		// the edit is a line of y or of x, it's followed by equal lines up to (i, j)
+		var edit DiffLine
+		editI := prevI
+		if prevK == k+1 {
+			edit = DiffLine{"+", y[prevJ]}
+		} else {
+			edit = DiffLine{"-", x[prevI]}
+			editI = prevI + 1
+		}
+		for i > editI {
+			i--
+			reversed = append(reversed, DiffLine{"=", x[i]})
+		}
+		reversed = append(reversed, edit)
+		i, j = prevI, prevJ
+	}
+	for i > 0 {
+		i--
+		reversed = append(reversed, DiffLine{"=", x[i]})
+	}
+
+	diff := make([]DiffLine, len(reversed))
+	for l, line := range reversed {
+		diff[len(reversed)-1-l] = line
+	}
+	return diff
+}
+
+func replaceLines(x []string, y []string) []DiffLine {
+	diff := make([]DiffLine, 0, len(x)+len(y))
+	for _, l := range x {
+		diff = append(diff, DiffLine{"-", l})
+	}
+	for _, l := range y {
+		diff = append(diff, DiffLine{"+", l})
+	}
+	return diff
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	cases := []struct {
+		name string
+		a    string
+		b    string
+		want []DiffLine
+	}{
+		{"equal", "a\nb", "a\nb", []DiffLine{{"=", "a"}, {"=", "b"}}},
+		{"insert", "a\nc", "a\nb\nc", []DiffLine{{"=", "a"}, {"+", "b"}, {"=", "c"}}},
+		{"delete", "a\nb\nc", "a\nc", []DiffLine{{"=", "a"}, {"-", "b"}, {"=", "c"}}},
+		{"change", "a\nb\nc", "a\nB\nc", []DiffLine{{"=", "a"}, {"-", "b"}, {"+", "B"}, {"=", "c"}}},
+		{"empty to text", "", "a", []DiffLine{{"-", ""}, {"+", "a"}}},
+		{"text to empty", "a", "", []DiffLine{{"-", "a"}, {"+", ""}}},
+		{"both empty", "", "", []DiffLine{{"=", ""}}},
+		{"moved line", "a\nb\nc\nd", "b\nc\na\nd",
+			[]DiffLine{{"-", "a"}, {"=", "b"}, {"=", "c"}, {"+", "a"}, {"=", "d"}}},
+		{"interleaved", "a\nx\nb\ny\nc", "a\nb\nz\nc",
+			[]DiffLine{{"=", "a"}, {"-", "x"}, {"=", "b"}, {"-", "y"}, {"+", "z"}, {"=", "c"}}},
+	}
+	for _, c := range cases {
+		if got := LineDiff(c.a, c.b); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: LineDiff = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// the diff applied to a gives b
+func TestLineDiffApplies(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8"
+	b := "0\n2\n3\nx\n5\n8\n9"
+	var before, after []string
+	for _, l := range LineDiff(a, b) {
+		if l.Op != "+" {
+			before = append(before, l.Text)
+		}
+		if l.Op != "-" {
+			after = append(after, l.Text)
+		}
+	}
+	if strings.Join(before, "\n") != a || strings.Join(after, "\n") != b {
+		t.Errorf("diff gives %q and %q", before, after)
+	}
+}
+
+// bodies that differ by too many lines are replaced instead of diffed
+func TestLineDiffLarge(t *testing.T) {
+	a := strings.Repeat("a\n", 15000)
+	b := strings.Repeat("b\n", 15000)
+	diff := LineDiff(a, b)
+	if len(diff) != 30001 || diff[0].Op != "-" || diff[len(diff)-2].Op != "+" {
+		t.Errorf("LineDiff of large bodies has %d lines", len(diff))
+	}
+}
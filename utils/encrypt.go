@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"io"
+	"strconv"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -17,3 +21,30 @@ func EncryptString(s string) string {
 	e := hex.EncodeToString(h.Sum(nil))
 	return e[:4] + e[len(e)-4:len(e)]
 }
+
+// HashIdentifier returns a keyed hash of an IP or a name that is saved instead of it
+func HashIdentifier(s string) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("default_salt")))
+	io.WriteString(mac, s)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PosterIDEpoch is the rotation period of the poster ID key at the time,
+// threads keep the epoch of their creation so their IDs don't change
+func PosterIDEpoch(t time.Time) int64 {
+	days := viper.GetInt64("poster_id_rotation_days")
+	if days <= 0 {
+		return 0
+	}
+	return t.Unix() / (days * 24 * 60 * 60)
+}
+
+// PosterID returns an ID of the IP that is unique to the thread,
+// the IDs of an IP in different threads can't be linked without the key of the epoch of the thread
+func PosterID(IP string, threadID int, epoch int64) string {
+	key := hmac.New(sha256.New, []byte(viper.GetString("poster_id_secret")))
+	io.WriteString(key, strconv.FormatInt(epoch, 10))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	io.WriteString(mac, IP+"/"+strconv.Itoa(threadID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:8]
+}
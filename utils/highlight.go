@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// language is the syntax that the highlighter recognizes in code blocks
+type language struct {
+	keywords     map[string]struct{}
+	lineComment  string
+	blockComment bool
+	// rawStrings are back quoted strings that may span lines
+	rawStrings bool
+}
+
+func newLanguage(lineComment string, blockComment bool, rawStrings bool, keywords string) language {
+	l := language{keywords: make(map[string]struct{}), lineComment: lineComment,
+		blockComment: blockComment, rawStrings: rawStrings}
+	for _, k := range strings.Fields(keywords) {
+		l.keywords[k] = struct{}{}
+	}
+	return l
+}
+
+var languages = map[string]language{
+	"go": newLanguage("//", true, true, `break case chan const continue default defer else
+		fallthrough for func go goto if import interface map package range return select
+		struct switch type var nil true false`),
+	"js": newLanguage("//", true, true, `break case catch class const continue debugger default
+		delete do else export extends finally for function if import in instanceof let new
+		return super switch this throw try typeof var void while with yield async await
+		null undefined true false`),
+	"python": newLanguage("#", false, false, `and as assert async await break class continue
+		def del elif else except finally for from global if import in is lambda nonlocal
+		not or pass raise return try while with yield None True False`),
+	"c": newLanguage("//", true, false, `auto break case char const continue default do double
+		else enum extern float for goto if int long register return short signed sizeof static
+		struct switch typedef union unsigned void volatile while class namespace template
+		public private protected virtual new delete true false nullptr`),
+	"java": newLanguage("//", true, false, `abstract boolean break byte case catch char class
+		continue default do double else enum extends final finally float for if implements
+		import instanceof int interface long new package private protected public return
+		short static super switch this throw throws try void while null true false`),
+	"rust": newLanguage("//", true, false, `as break const continue crate else enum extern fn
+		for if impl in let loop match mod move mut pub ref return self Self static struct
+		trait type unsafe use where while true false`),
+	"sh": newLanguage("#", false, false, `if then else elif fi for while do done case esac
+		function in return local export`),
+	"sql": newLanguage("--", true, false, `select from where insert into values update set
+		delete create table drop alter join inner left right on as and or not null is in
+		order by group having limit offset returning SELECT FROM WHERE INSERT INTO VALUES
+		UPDATE SET DELETE CREATE TABLE DROP ALTER JOIN INNER LEFT RIGHT ON AS AND OR NOT
+		NULL IS IN ORDER BY GROUP HAVING LIMIT OFFSET RETURNING`),
+}
+
+// languageAliases are the other names of the languages in "[code=lang]"
+var languageAliases = map[string]string{
+	"golang": "go", "javascript": "js", "ts": "js", "typescript": "js",
+	"py": "python", "cpp": "c", "c++": "c", "rs": "rust", "bash": "sh",
+	"shell": "sh",
+}
+
+// lookupLanguage returns the name of the language or an empty string if it is unknown
+func lookupLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	if alias, ok := languageAliases[lang]; ok {
+		lang = alias
+	}
+	if _, ok := languages[lang]; !ok {
+		return ""
+	}
+	return lang
+}
+
+func hasPrefix(src []rune, i int, prefix string) bool {
+	for _, r := range prefix {
+		if i >= len(src) || src[i] != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// highlight escapes the code and wraps the keywords, strings, comments and numbers
+// of the language in spans, code of unknown languages is only escaped
+func highlight(code string, lang string) string {
+	l, ok := languages[lang]
+	if !ok {
+		return html.EscapeString(code)
+	}
+	var b strings.Builder
+	token := func(class string, s string) {
+		b.WriteString(`<span class="hl-` + class + `">` + html.EscapeString(s) + `</span>`)
+	}
+	src := []rune(code)
+	for i := 0; i < len(src); {
+		r := src[i]
+		switch {
+		case l.lineComment != "" && hasPrefix(src, i, l.lineComment):
+			j := i
+			for ; j < len(src) && src[j] != '\n'; j++ {
+			}
+			token("comment", string(src[i:j]))
+			i = j
+		case l.blockComment && hasPrefix(src, i, "/*"):
+			j := i + 2
+			for ; j < len(src) && !hasPrefix(src, j, "*/"); j++ {
+			}
+			if j < len(src) {
+				j += 2
+			}
+			token("comment", string(src[i:j]))
+			i = j
+		case r == '"' || r == '\'' || (r == '`' && l.rawStrings):
+			j := i + 1
+			for ; j < len(src) && src[j] != r; j++ {
+				if src[j] == '\\' && r != '`' {
+					j++
+				} else if src[j] == '\n' && r != '`' {
+					break
+				}
+			}
+			if j < len(src) && src[j] == r {
+				j++
+			}
+			if j > len(src) {
+				j = len(src)
+			}
+			token("string", string(src[i:j]))
+			i = j
+		case unicode.IsDigit(r):
+			j := i + 1
+			for ; j < len(src) && (isIdent(src[j]) || src[j] == '.'); j++ {
+			}
+			token("number", string(src[i:j]))
+			i = j
+		case isIdent(r):
+			j := i + 1
+			for ; j < len(src) && isIdent(src[j]); j++ {
+			}
+			word := string(src[i:j])
+			if _, ok := l.keywords[word]; ok {
+				token("keyword", word)
+			} else {
+				b.WriteString(html.EscapeString(word))
+			}
+			i = j
+		default:
+			b.WriteString(html.EscapeString(string(r)))
+			i++
+		}
+	}
+	return b.String()
+}
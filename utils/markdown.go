@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"html"
 	"regexp"
 	"strconv"
 
@@ -14,26 +15,153 @@ var p *bluemonday.Policy
 func init() {
 	p = bluemonday.UGCPolicy()
 	p.AllowAttrs("id").Matching(bluemonday.Integer).OnElements("span")
-	p.AllowAttrs("class").Matching(regexp.MustCompile(`^reply$`)).OnElements("span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(
+		`^(reply( dead-reply)?|greentext|spoiler|math|hl-(keyword|string|comment|number))$`)).OnElements("span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[a-z]+$`)).OnElements("code")
+	p.AllowAttrs("data-thread").Matching(bluemonday.Integer).OnElements("span")
+	p.AllowAttrs("data-board").Matching(regexp.MustCompile(`^[a-zA-Z0-9_]+$`)).OnElements("span")
 }
 
-func HTMLAndReplies(body string) (string, []int64) {
-	unsafeWithReplies, replies := handleReplies(body)
+// quoteRegex matches ">>>/b/123" quotes of another board and ">>123" quotes of the same board
+var quoteRegex = regexp.MustCompile(`>>>/([a-zA-Z0-9_]+)/([0-9]+)|(>>|<<)([0-9]+)`)
+
+// replyRegex matches the rendered quotes of posts that exist
+var replyRegex = regexp.MustCompile(`<span id="([0-9]+)" class="reply" data-thread="[0-9]+" data-board="[a-zA-Z0-9_]+">`)
+
+// Quote is a link to a post, BoardURI is empty for quotes of the same board
+type Quote struct {
+	BoardURI string
+	PostID   int64
+}
+
+// QuoteTarget is the location of a quoted post
+type QuoteTarget struct {
+	PostID   int64  `json:"post_id"`
+	ThreadID int64  `json:"thread_id"`
+	BoardURI string `json:"board_uri"`
+}
+
+func parseQuote(match []string) Quote {
+	if match[1] != "" {
+		id, _ := strconv.ParseInt(match[2], 10, 64)
+		return Quote{BoardURI: match[1], PostID: id}
+	}
+	id, _ := strconv.ParseInt(match[4], 10, 64)
+	return Quote{PostID: id}
+}
+
+// ParseQuotes returns the unique quotes of the body
+func ParseQuotes(body string) []Quote {
+	unique := make(map[Quote]struct{})
+	var quotes []Quote
+	for _, match := range quoteRegex.FindAllStringSubmatch(body, -1) {
+		q := parseQuote(match)
+		if _, ok := unique[q]; !ok {
+			unique[q] = struct{}{}
+			quotes = append(quotes, q)
+		}
+	}
+	return quotes
+}
+
+// Markup are the board markup extensions that are enabled on top of markdown
+type Markup struct {
+	Greentext bool `json:"greentext"`
+	Spoilers  bool `json:"spoilers"`
+	Code      bool `json:"code_blocks"`
+	Math      bool `json:"math"`
+}
+
+// DefaultMarkup is used when the markup of the board is unknown
+var DefaultMarkup = Markup{Greentext: true, Spoilers: true, Code: true}
+
+var (
+	codeRegex       = regexp.MustCompile(`(?s)\[code(?:=([a-zA-Z0-9+#-]*))?\]\n?(.*?)\n?\[/code\]`)
+	mathRegex       = regexp.MustCompile(`(?s)\[math\](.+?)\[/math\]`)
+	inlineCodeRegex = regexp.MustCompile("`[^`\n]+`")
+	spoilerRegex    = regexp.MustCompile(`\[spoiler\](.+?)\[/spoiler\]|\|\|([^|\n]+?)\|\|`)
+	greentextRegex  = regexp.MustCompile(`(?m)^>(.*)$`)
+	// placeholders are private use characters that are removed from the body
+	placeholderChars    = regexp.MustCompile(`[\x{E000}-\x{E005}]`)
+	blockPlaceholder    = regexp.MustCompile(`(?:<p>)?\x{E000}([0-9]+)\x{E001}(?:</p>)?`)
+	inlinePlaceholder   = regexp.MustCompile(`\x{E002}([0-9]+)\x{E003}`)
+	markdownPlaceholder = regexp.MustCompile(`\x{E004}([0-9]+)\x{E005}`)
+)
+
+// placeholders keeps parts of the body out of the markdown renderer
+type placeholders []string
+
+func (ps *placeholders) add(open string, s string, close string) string {
+	*ps = append(*ps, s)
+	return open + strconv.Itoa(len(*ps)-1) + close
+}
+
+func (ps placeholders) restore(r *regexp.Regexp, s string) string {
+	return r.ReplaceAllStringFunc(s, func(m string) string {
+		i, _ := strconv.Atoi(r.FindStringSubmatch(m)[1])
+		return ps[i]
+	})
+}
+
+// HTMLAndReplies renders the body and returns the IDs of the quoted posts,
+// quotes that are missing from targets are rendered as dead links.
+// code blocks and math are rendered after markdown so markdown can't change them
+func HTMLAndReplies(body string, targets map[Quote]QuoteTarget, markup Markup) (string, []int64) {
+	body = placeholderChars.ReplaceAllString(body, "")
+	var rendered, markdown placeholders
+	if markup.Code {
+		body = codeRegex.ReplaceAllStringFunc(body, func(s string) string {
+			m := codeRegex.FindStringSubmatch(s)
+			lang := lookupLanguage(m[1])
+			class := ""
+			if lang != "" {
+				class = ` class="language-` + lang + `"`
+			}
+			code := "<pre><code" + class + ">" + highlight(m[2], lang) + "</code></pre>"
+			// blank lines make the code a paragraph of its own
+			return "\n\n" + rendered.add("\uE000", code, "\uE001") + "\n\n"
+		})
+	}
+	if markup.Math {
+		body = mathRegex.ReplaceAllStringFunc(body, func(s string) string {
+			tex := mathRegex.FindStringSubmatch(s)[1]
+			return rendered.add("\uE002", `<span class="math">`+html.EscapeString(tex)+"</span>", "\uE003")
+		})
+	}
+	// markdown code spans are rendered by markdown without the board markup
+	body = inlineCodeRegex.ReplaceAllStringFunc(body, func(s string) string {
+		return markdown.add("\uE004", s, "\uE005")
+	})
+
+	unsafeWithReplies, replies := handleReplies(body, targets)
+	if markup.Spoilers {
+		unsafeWithReplies = spoilerRegex.ReplaceAllString(unsafeWithReplies, `<span class="spoiler">$1$2</span>`)
+	}
+	if markup.Greentext {
+		unsafeWithReplies = greentextRegex.ReplaceAllString(unsafeWithReplies, `<span class="greentext">>$1</span>`)
+	}
+	unsafeWithReplies = markdown.restore(markdownPlaceholder, unsafeWithReplies)
+
 	options := blackfriday.WithExtensions(blackfriday.CommonExtensions | blackfriday.HardLineBreak)
-	unsafe := blackfriday.Run([]byte(unsafeWithReplies), options)
-	html := p.SanitizeBytes(unsafe)
-	return string(html), replies
+	unsafe := string(blackfriday.Run([]byte(unsafeWithReplies), options))
+	unsafe = rendered.restore(blockPlaceholder, unsafe)
+	unsafe = rendered.restore(inlinePlaceholder, unsafe)
+	return p.Sanitize(unsafe), replies
 }
 
-func handleReplies(html string) (string, []int64) {
+func handleReplies(html string, targets map[Quote]QuoteTarget) (string, []int64) {
 	// make unique map, empty struct occupies no additinal space
 	uniqueReplies := make(map[int64]struct{})
-	r := regexp.MustCompile(`(>>|<<)[0-9]+`)
-	h := r.ReplaceAllStringFunc(html, func(s string) string {
-		id, _ := strconv.ParseInt(s[2:], 10, 64)
-		uniqueReplies[id] = struct{}{}
+	h := quoteRegex.ReplaceAllStringFunc(html, func(s string) string {
+		q := parseQuote(quoteRegex.FindStringSubmatch(s))
+		t, ok := targets[q]
+		if !ok {
+			return fmt.Sprintf(`<span id="%d" class="reply dead-reply">%s</span>`+"\n", q.PostID, s)
+		}
+		uniqueReplies[q.PostID] = struct{}{}
 		// Added \n after each reply to enable blockqouting in next line
-		return fmt.Sprintf(`<span id="%d" class="reply">%s</span>`+"\n", id, s)
+		return fmt.Sprintf(`<span id="%d" class="reply" data-thread="%d" data-board="%s">%s</span>`+"\n",
+			q.PostID, t.ThreadID, t.BoardURI, s)
 	})
 	var replies []int64
 	for id := range uniqueReplies {
@@ -41,3 +169,16 @@ func handleReplies(html string) (string, []int64) {
 	}
 	return h, replies
 }
+
+// RetargetReplies updates the thread and the board of the rendered quotes of the posts in targets,
+// it is used when the quoted posts are moved to another thread
+func RetargetReplies(html string, targets map[int64]QuoteTarget) string {
+	return replyRegex.ReplaceAllStringFunc(html, func(s string) string {
+		id, _ := strconv.ParseInt(replyRegex.FindStringSubmatch(s)[1], 10, 64)
+		t, ok := targets[id]
+		if !ok {
+			return s
+		}
+		return fmt.Sprintf(`<span id="%d" class="reply" data-thread="%d" data-board="%s">`, id, t.ThreadID, t.BoardURI)
+	})
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+var markupAll = Markup{Greentext: true, Spoilers: true, Code: true, Math: true}
+
+var markupCorpus = []struct {
+	name   string
+	body   string
+	markup Markup
+	html   string
+}{
+	{"plain", "hello", markupAll, "<p>hello</p>\n"},
+	{"greentext", ">implying\nnormal", markupAll,
+		"<p><span class=\"greentext\">&gt;implying</span><br/>\nnormal</p>\n"},
+	{"greentext with markdown", ">green *em*", markupAll,
+		"<p><span class=\"greentext\">&gt;green <em>em</em></span></p>\n"},
+	{"greentext disabled is a blockquote", ">quote", Markup{},
+		"<blockquote>\n<p>quote</p>\n</blockquote>\n"},
+	{"spoilers", "a [spoiler]secret[/spoiler] b ||also|| c", markupAll,
+		"<p>a <span class=\"spoiler\">secret</span> b <span class=\"spoiler\">also</span> c</p>\n"},
+	{"spoiler in bold", "**bold [spoiler]in[/spoiler]**", markupAll,
+		"<p><strong>bold <span class=\"spoiler\">in</span></strong></p>\n"},
+	{"spoilers disabled", "[spoiler]x[/spoiler]", Markup{},
+		"<p>[spoiler]x[/spoiler]</p>\n"},
+	{"code span is not markup", "`a || b || c`", markupAll,
+		"<p><code>a || b || c</code></p>\n"},
+	{"code block", "[code=go]\nfunc main() { // hi\n\ts := \"x<y\"\n\treturn 42\n}\n[/code]\nafter", markupAll,
+		"<pre><code class=\"language-go\"><span class=\"hl-keyword\">func</span> main() { " +
+			"<span class=\"hl-comment\">// hi</span>\n\ts := <span class=\"hl-string\">&#34;x&lt;y&#34;</span>\n\t" +
+			"<span class=\"hl-keyword\">return</span> <span class=\"hl-number\">42</span>\n}</code></pre>\n\n<p>after</p>\n"},
+	{"code block alias", "[code=py]pass # no[/code]", markupAll,
+		"<pre><code class=\"language-python\"><span class=\"hl-keyword\">pass</span> <span class=\"hl-comment\"># no</span></code></pre>\n"},
+	{"code block unknown language is escaped", "[code=lisp]<script>alert(1)</script>[/code]", markupAll,
+		"<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></pre>\n"},
+	{"code block is not markup", "[code]>>5 ||x||[/code]", markupAll,
+		"<pre><code>&gt;&gt;5 ||x||</code></pre>\n"},
+	{"code blocks disabled", "[code]x[/code]", Markup{},
+		"<p>[code]x[/code]</p>\n"},
+	{"math", "[math]x_1 < *y*[/math] text", markupAll,
+		"<p><span class=\"math\">x_1 &lt; *y*</span> text</p>\n"},
+	{"math disabled", "[math]x_1[/math]", DefaultMarkup,
+		"<p>[math]x_1[/math]</p>\n"},
+	{"placeholders can't be injected", "text \ue0000\ue001 \ue0020\ue003 injected", markupAll,
+		"<p>text 0 0 injected</p>\n"},
+	{"html is sanitized", "<script>alert(1)</script>", markupAll, "<p></p>\n"},
+	{"classes are sanitized", `<span class="evil">x</span>`, markupAll, "<p><span>x</span></p>\n"},
+}
+
+func TestHTMLAndRepliesMarkup(t *testing.T) {
+	for _, c := range markupCorpus {
+		html, _ := HTMLAndReplies(c.body, nil, c.markup)
+		if html != c.html {
+			t.Errorf("%s: HTMLAndReplies(%q) = %q, want %q", c.name, c.body, html, c.html)
+		}
+	}
+}
+
+func TestHTMLAndRepliesQuotes(t *testing.T) {
+	targets := map[Quote]QuoteTarget{
+		{PostID: 12}:                {PostID: 12, ThreadID: 5, BoardURI: "a"},
+		{BoardURI: "b", PostID: 34}: {PostID: 34, ThreadID: 7, BoardURI: "b"},
+	}
+	html, replies := HTMLAndReplies(">>12 and >>>/b/34 and >>99", targets, markupAll)
+	want := "<p><span id=\"12\" class=\"reply\" data-thread=\"5\" data-board=\"a\">&gt;&gt;12</span><br/>\n" +
+		" and <span id=\"34\" class=\"reply\" data-thread=\"7\" data-board=\"b\">&gt;&gt;&gt;/b/34</span><br/>\n" +
+		" and <span id=\"99\" class=\"reply dead-reply\">&gt;&gt;99</span></p>\n"
+	if html != want {
+		t.Errorf("HTMLAndReplies = %q, want %q", html, want)
+	}
+	if len(replies) != 2 {
+		t.Errorf("replies = %v, want the resolved quotes", replies)
+	}
+}
+
+func TestRetargetReplies(t *testing.T) {
+	html := "<p><span id=\"12\" class=\"reply\" data-thread=\"5\" data-board=\"a\">&gt;&gt;12</span><br/>\n" +
+		" and <span id=\"34\" class=\"reply\" data-thread=\"7\" data-board=\"b\">&gt;&gt;&gt;/b/34</span><br/>\n" +
+		" and <span id=\"99\" class=\"reply dead-reply\">&gt;&gt;99</span></p>\n"
+	got := RetargetReplies(html, map[int64]QuoteTarget{
+		12: {PostID: 12, ThreadID: 8, BoardURI: "c"},
+		99: {PostID: 99, ThreadID: 8, BoardURI: "c"},
+	})
+	want := "<p><span id=\"12\" class=\"reply\" data-thread=\"8\" data-board=\"c\">&gt;&gt;12</span><br/>\n" +
+		" and <span id=\"34\" class=\"reply\" data-thread=\"7\" data-board=\"b\">&gt;&gt;&gt;/b/34</span><br/>\n" +
+		" and <span id=\"99\" class=\"reply dead-reply\">&gt;&gt;99</span></p>\n"
+	if got != want {
+		t.Errorf("RetargetReplies = %q, want %q", got, want)
+	}
+}
+
+func TestParseQuotes(t *testing.T) {
+	quotes := ParseQuotes(">>12 >>>/b/34 >>12 <<7 >>>99")
+	want := []Quote{{PostID: 12}, {BoardURI: "b", PostID: 34}, {PostID: 7}, {PostID: 99}}
+	if !reflect.DeepEqual(quotes, want) {
+		t.Errorf("ParseQuotes = %v, want %v", quotes, want)
+	}
+}
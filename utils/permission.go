@@ -1,26 +1,92 @@
 package utils
 
+// Capabilities are the actions that staff roles can be allowed to do
 const (
-	ADMIN   = "admin"
-	MOD     = "mod"
-	JANITOR = "janitor"
+	// DeletePost deletes posts, threads and files
+	DeletePost = "delete_post"
+	Ban        = "ban"
+	// BanRange bans IPs and IP ranges that are not of a post
+	BanRange = "ban_range"
+	Sticky   = "sticky"
+	Lock     = "lock"
+	// ManageThreads toggles autosage and cyclical threads, moves, merges and splits threads and manages polls
+	ManageThreads = "manage_threads"
+	// EditPost edits posts, views their revisions and spoilers their files
+	EditPost = "edit_post"
+	// Moderate views the management pages and the reports of the board
+	Moderate         = "moderate"
+	ManageBoardUsers = "manage_board_users"
+	// PosterHistory lists the posts of the author of a post
+	PosterHistory = "poster_history"
+	// ViewIP shows the IPs of the posters in the poster history
+	ViewIP        = "view_ip"
+	ManageFilters = "manage_filters"
+	// ManageBoards creates boards and changes their settings and report categories
+	ManageBoards = "manage_boards"
+	// ManageUsers registers and deletes users and edits the roles
+	ManageUsers = "manage_users"
+	// Capcode posts with the role of the user as the capcode
+	Capcode = "capcode"
 )
 
-var permissions = map[string]int{ADMIN: 1, MOD: 2, JANITOR: 3}
+var capabilities = map[string]struct{}{DeletePost: {}, Ban: {}, BanRange: {}, Sticky: {}, Lock: {},
+	ManageThreads: {}, EditPost: {}, Moderate: {}, ManageBoardUsers: {}, PosterHistory: {}, ViewIP: {}, ManageFilters: {},
+	ManageBoards: {}, ManageUsers: {}, Capcode: {}}
 
-func PermissionExists(p string) bool {
-	_, ok := permissions[p]
+// globalCapabilities are not of a board, only the role of the user can have them
+// and they can't be granted on a board
+var globalCapabilities = map[string]struct{}{BanRange: {}, ManageBoards: {}, ManageUsers: {}}
+
+// IsGlobalCapability is true if the capability is only checked against the role of the user
+func IsGlobalCapability(capability string) bool {
+	_, ok := globalCapabilities[capability]
 	return ok
 }
 
-func CheckPermission(minAllowedPermission string, currentPermission string) bool {
-	a, ok := permissions[minAllowedPermission]
-	if !ok {
-		return false
+// ValidCapabilities is true if all the capabilities exist
+func ValidCapabilities(caps []string) bool {
+	for _, c := range caps {
+		if _, ok := capabilities[c]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// HasCapability is true if the capability is one of the capabilities
+func HasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitCapabilities returns the capabilities that are also in limit
+func LimitCapabilities(caps []string, limit []string) []string {
+	limited := []string{}
+	for _, c := range caps {
+		if HasCapability(limit, c) {
+			limited = append(limited, c)
+		}
+	}
+	return limited
+}
+
+// EffectiveCapabilities are the capabilities of the role on a board with the
+// capabilities that were granted and revoked on the board, global capabilities can't be granted
+func EffectiveCapabilities(role []string, granted []string, revoked []string) []string {
+	caps := []string{}
+	for _, c := range role {
+		if !HasCapability(revoked, c) && !HasCapability(caps, c) {
+			caps = append(caps, c)
+		}
 	}
-	c, ok := permissions[currentPermission]
-	if !ok {
-		return false
+	for _, c := range granted {
+		if !IsGlobalCapability(c) && !HasCapability(revoked, c) && !HasCapability(caps, c) {
+			caps = append(caps, c)
+		}
 	}
-	return c <= a
+	return caps
 }
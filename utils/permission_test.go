@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEffectiveCapabilities(t *testing.T) {
+	cases := []struct {
+		name    string
+		role    []string
+		granted []string
+		revoked []string
+		want    []string
+	}{
+		{"role only", []string{DeletePost, Ban}, nil, nil, []string{DeletePost, Ban}},
+		{"granted", []string{DeletePost}, []string{Ban}, nil, []string{DeletePost, Ban}},
+		{"revoked", []string{DeletePost, Ban}, nil, []string{Ban}, []string{DeletePost}},
+		{"revoked wins over granted", []string{DeletePost}, []string{Ban}, []string{Ban}, []string{DeletePost}},
+		{"global can't be granted", []string{DeletePost},
+			[]string{ManageUsers, ManageBoards, BanRange}, nil, []string{DeletePost}},
+		{"global of the role", []string{ManageUsers}, nil, nil, []string{ManageUsers}},
+	}
+	for _, c := range cases {
+		if got := EffectiveCapabilities(c.role, c.granted, c.revoked); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: EffectiveCapabilities = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
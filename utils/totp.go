@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods before and after the current period that are accepted,
+	// for clocks that are a little off
+	totpSkew = 1
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret of 160 bits, the size RFC 4226 recommends
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// TOTPURI is the otpauth URI of the secret that authenticator apps read from a QR code
+func TOTPURI(issuer string, account string, secret string) string {
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account}
+	u.RawQuery = url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}.Encode()
+	return u.String()
+}
+
+// totpCode is the HOTP code (RFC 4226) of the period, with the given number of digits
+func totpCode(key []byte, period int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(period))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// CheckTOTP returns the period of the code if it is a valid code of the secret at the time.
+// the period should be saved and codes of the same or earlier periods refused so a code can't be reused
+func CheckTOTP(secret string, code string, t time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for period := current - totpSkew; period <= current+totpSkew; period++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, period, totpDigits)), []byte(code)) == 1 {
+			return period, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n random one time codes like "a1b2c-3d4e5"
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	b := make([]byte, 5)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode is the hash of the recovery code that is saved instead of the code,
+// the codes are random so a fast hash is enough
+func HashRecoveryCode(code string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors of RFC 6238, the secret is the ASCII "12345678901234567890"
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		if got := totpCode(key, v.unix/totpPeriod, 8); got != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+	if period, ok := CheckTOTP(secret, "287082", now); !ok || period != 1 {
+		t.Errorf("CheckTOTP of the current code = %d, %v", period, ok)
+	}
+	if _, ok := CheckTOTP(secret, "287082", now.Add(totpPeriod*time.Second)); !ok {
+		t.Error("the code of the previous period is refused")
+	}
+	if _, ok := CheckTOTP(secret, "287082", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Error("an old code is accepted")
+	}
+	if _, ok := CheckTOTP(secret, "287083", now); ok {
+		t.Error("a wrong code is accepted")
+	}
+	if _, ok := CheckTOTP("not base32!", "287082", now); ok {
+		t.Error("an invalid secret is accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("board", "mod 1", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/board:mod 1" {
+		t.Errorf("TOTPURI = %s", u)
+	}
+	if q := u.Query(); q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "board" || q.Get("digits") != "6" {
+		t.Errorf("TOTPURI query = %v", q)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || seen[c] {
+			t.Errorf("recovery code %q", c)
+		}
+		seen[c] = true
+	}
+	if HashRecoveryCode(" "+codes[0]+" ") != HashRecoveryCode(codes[0]) {
+		t.Error("the hash of a code with spaces is different")
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultAuthor is the name of posters that only entered a tripcode password
+const DefaultAuthor = "Anonymous"
+
+// capcodes that can be requested with "name## Role"
+var capcodes = map[string]string{"mod": "mod", "admin": "admin"}
+
+// Author is the parsed author field of a post
+type Author struct {
+	Name     string
+	Tripcode string
+	// Capcode is the role badge requested by the poster, it must be verified
+	// against the logged in user before it is used
+	Capcode string
+}
+
+// ParseAuthor parses "name#password" into a classic tripcode,
+// "name##password" into a secure tripcode and "name## Mod" into a capcode request.
+// password is the legacy tripcode field, it is used as a secure tripcode password
+func ParseAuthor(author string, password string) Author {
+	a := Author{Name: author}
+	if i := strings.Index(author, "##"); i != -1 {
+		a.Name = author[:i]
+		secure := author[i+2:]
+		if role, ok := capcodes[strings.ToLower(strings.TrimSpace(secure))]; ok &&
+			strings.HasPrefix(secure, " ") {
+			a.Capcode = role
+		} else {
+			a.Tripcode = SecureTripcode(secure)
+		}
+	} else if i := strings.Index(author, "#"); i != -1 {
+		a.Name = author[:i]
+		a.Tripcode = ClassicTripcode(author[i+1:])
+	} else if password != "" {
+		a.Tripcode = SecureTripcode(password)
+	}
+
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		a.Name = DefaultAuthor
+	}
+	return a
+}
+
+// ClassicTripcode is the crypt(3) based tripcode used by most image boards,
+// the same password gives the same tripcode on every board
+func ClassicTripcode(password string) string {
+	if password == "" {
+		return ""
+	}
+	salt := []byte((password + "H..")[1:3])
+	for i, c := range salt {
+		switch {
+		case c < '.' || c > 'z':
+			salt[i] = '.'
+		case c >= ':' && c <= '@':
+			salt[i] = c - ':' + 'A'
+		case c >= '[' && c <= '`':
+			salt[i] = c - '[' + 'a'
+		}
+	}
+	trip := crypt(password, string(salt))
+	return "!" + trip[len(trip)-10:]
+}
+
+// SecureTripcode can't be cracked without the server tripcode secret
+func SecureTripcode(password string) string {
+	if password == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(viper.GetString("tripcode_secret")))
+	io.WriteString(mac, password)
+	return "!!" + base64.StdEncoding.EncodeToString(mac.Sum(nil))[:10]
+}
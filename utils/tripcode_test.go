@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// known answers of the traditional crypt(3)
+func TestCrypt(t *testing.T) {
+	vectors := []struct {
+		password, salt, hash string
+	}{
+		{"tripcode", "ri", "riA3GqYIJ3Obs"},
+		{"password", "as", "as1ozOtJW9BFA"},
+		{"test", "aa", "aaqPiZY5xR5l."},
+		{"a", "H.", "H.6ZnBI2EKkq."},
+	}
+	for _, v := range vectors {
+		if got := crypt(v.password, v.salt); got != v.hash {
+			t.Errorf("crypt(%q, %q) = %s, want %s", v.password, v.salt, got, v.hash)
+		}
+	}
+}
+
+func TestClassicTripcode(t *testing.T) {
+	cases := []struct {
+		password, tripcode string
+	}{
+		{"tripcode", "!3GqYIJ3Obs"},
+		{"password", "!ozOtJW9BFA"},
+		// only the first 8 characters are used
+		{"tripcode123", "!3GqYIJ3Obs"},
+		// the salt of a single character is padded with "H."
+		{"a", "!ZnBI2EKkq."},
+		// salt characters out of the alphabet are replaced
+		{"x:[", "!H3mfr7kMG6"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := ClassicTripcode(c.password); got != c.tripcode {
+			t.Errorf("ClassicTripcode(%q) = %s, want %s", c.password, got, c.tripcode)
+		}
+	}
+}
+
+func TestSecureTripcode(t *testing.T) {
+	viper.Set("tripcode_secret", "secret")
+	defer viper.Set("tripcode_secret", nil)
+
+	if got := SecureTripcode("password"); got != "!!jJojniH3u5" {
+		t.Errorf("SecureTripcode = %s, want the HMAC-SHA256 of the secret", got)
+	}
+	if SecureTripcode("") != "" {
+		t.Error("an empty password has a tripcode")
+	}
+	viper.Set("tripcode_secret", "another secret")
+	if SecureTripcode("password") == "!!jJojniH3u5" {
+		t.Error("the tripcode doesn't depend on the secret")
+	}
+}
+
+func TestParseAuthor(t *testing.T) {
+	viper.Set("tripcode_secret", "secret")
+	defer viper.Set("tripcode_secret", nil)
+
+	cases := []struct {
+		author, password string
+		want             Author
+	}{
+		{"name", "", Author{Name: "name"}},
+		{"", "", Author{Name: DefaultAuthor}},
+		{" name ", "", Author{Name: "name"}},
+		{"name#tripcode", "", Author{Name: "name", Tripcode: "!3GqYIJ3Obs"}},
+		{"#tripcode", "", Author{Name: DefaultAuthor, Tripcode: "!3GqYIJ3Obs"}},
+		{"name##password", "", Author{Name: "name", Tripcode: "!!jJojniH3u5"}},
+		// the legacy tripcode field is a secure tripcode password
+		{"name", "pw", Author{Name: "name", Tripcode: "!!puzy4FyxQH"}},
+		{"name#tripcode", "pw", Author{Name: "name", Tripcode: "!3GqYIJ3Obs"}},
+		// capcodes need a space after "##"
+		{"name## Mod", "", Author{Name: "name", Capcode: "mod"}},
+		{"## admin", "", Author{Name: DefaultAuthor, Capcode: "admin"}},
+		{"name##mod", "", Author{Name: "name", Tripcode: "!!3axIsScaJg"}},
+		// unknown roles are secure tripcode passwords
+		{"name## janitor", "", Author{Name: "name", Tripcode: "!!zLY3M7e/3G"}},
+	}
+	for _, c := range cases {
+		if got := ParseAuthor(c.author, c.password); got != c.want {
+			t.Errorf("ParseAuthor(%q, %q) = %+v, want %+v", c.author, c.password, got, c.want)
+		}
+	}
+}